@@ -0,0 +1,595 @@
+// Copyright 2026 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// checkExpected verifies the actual output of a directive against its
+// expected output, taking meta-arguments into account. It returns a failure
+// message, or the empty string if the output is as expected.
+func (r *testDataReader) checkExpected(d *TestData, actual string) string {
+	if r.isIgnored(d) {
+		return ""
+	}
+	if label, ok := d.metaValue("expect-same-as"); ok {
+		return r.checkSameAs(d, label, actual)
+	}
+	expected, err := r.expandBackRefs(d)
+	if err != nil {
+		return fmt.Sprintf("%s: %v", showPos(d.Pos), err)
+	}
+	expected = r.normalize(d.Cmd, r.stripInlineComments(expected))
+	switch {
+	case d.hasMetaFlag("contains"):
+		return checkContains(d, expected, actual, true /* contains */)
+	case d.hasMetaFlag("not-contains"):
+		return checkContains(d, expected, actual, false /* contains */)
+	case d.hasMetaFlag("multiset"):
+		return checkMultiset(d, expected, actual)
+	case d.hasMetaFlag("table"):
+		return checkTable(d, expected, actual)
+	case d.hasMetaFlag("one-of"):
+		return checkOneOf(d, expected, actual)
+	}
+	if tol, ok := d.metaFloat("tolerance"); ok {
+		return checkTolerance(d, tol, expected, actual)
+	}
+	if cmp, ok := r.opts.comparators[d.Cmd]; ok {
+		if equal, diff := cmp(expected, actual); !equal {
+			return fmt.Sprintf("\n%s:\n %s\noutput didn't match expected:\n%s",
+				showPos(d.Pos), d.Input, diff)
+		}
+		return ""
+	}
+	if expected != actual {
+		return mismatch(d, expected, actual)
+	}
+	return ""
+}
+
+// preserveExpected returns true if the expected block of the directive must be
+// left untouched when rewriting.
+func (r *testDataReader) preserveExpected(d *TestData, actual string) bool {
+	if _, ok := d.metaValue("expect-same-as"); ok {
+		return true
+	}
+	if r.isIgnored(d) || d.hasMetaFlag("contains") || d.hasMetaFlag("not-contains") ||
+		d.hasMetaFlag("knownfail") {
+		return true
+	}
+	if !r.inRewrittenSubTest() {
+		return true
+	}
+	if d.hasMetaFlag("one-of") && r.matchesAlternative(d, actual) {
+		return true
+	}
+	// Keep back-references as long as they still reflect the actual output.
+	expected, err := r.expandBackRefs(d)
+	return err == nil && expected != d.Expected && expected == actual
+}
+
+// inRewrittenSubTest returns false if -rewrite-subtest restricts rewriting to
+// a subtest which the current directive is not part of.
+func (r *testDataReader) inRewrittenSubTest() bool {
+	if *rewriteSubTest == "" {
+		return true
+	}
+	for _, st := range r.subTests {
+		if st.name == *rewriteSubTest {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSameAs verifies that the actual output of a directive with the
+// expect-same-as meta-argument is identical to that of the labeled directive.
+func (r *testDataReader) checkSameAs(d *TestData, label, actual string) string {
+	if r.parallel() {
+		return fmt.Sprintf("%s: expect-same-as cannot be used with ParallelDirectives",
+			showPos(d.Pos))
+	}
+	other, ok := r.outputs[label]
+	if !ok {
+		return fmt.Sprintf("%s: no earlier directive with label=%s", showPos(d.Pos), label)
+	}
+	if other != actual {
+		return fmt.Sprintf("%s: output differs from that of the directive with label=%s:%s",
+			showPos(d.Pos), label, mismatch(d, other, actual))
+	}
+	return ""
+}
+
+// normalize applies the Redactions registered for the command to an output,
+// and removes the lines ignored with IgnoreLinePrefixes.
+func (r *testDataReader) normalize(cmd, output string) string {
+	for _, red := range r.opts.redactions[cmd] {
+		output = red.Re.ReplaceAllString(output, red.Repl)
+	}
+	if len(r.opts.ignoreLinePrefixes) > 0 {
+		output = r.dropIgnoredLines(output)
+	}
+	return output
+}
+
+// dropIgnoredLines removes the lines of an output which start with one of the
+// prefixes given with IgnoreLinePrefixes.
+func (r *testDataReader) dropIgnoredLines(output string) string {
+	var buf strings.Builder
+	for _, line := range strings.SplitAfter(output, "\n") {
+		ignored := false
+		for _, prefix := range r.opts.ignoreLinePrefixes {
+			if strings.HasPrefix(line, prefix) {
+				ignored = true
+				break
+			}
+		}
+		if !ignored {
+			buf.WriteString(line)
+		}
+	}
+	return buf.String()
+}
+
+// isInlineComment returns true if a line of an expected block is an
+// annotation recognized with InlineComments.
+func (r *testDataReader) isInlineComment(line string) bool {
+	return r.opts.inlineComments != "" && strings.HasPrefix(line, r.opts.inlineComments)
+}
+
+// stripInlineComments removes the annotations recognized with InlineComments
+// from an expected output.
+func (r *testDataReader) stripInlineComments(expected string) string {
+	if r.opts.inlineComments == "" {
+		return expected
+	}
+	var buf strings.Builder
+	for _, line := range strings.SplitAfter(expected, "\n") {
+		if !r.isInlineComment(line) {
+			buf.WriteString(line)
+		}
+	}
+	return buf.String()
+}
+
+// restoreInlineComments carries the annotations recognized with InlineComments
+// over from an expected output to the actual output which replaces it when
+// rewriting. Each annotation is kept in front of the line which followed it in
+// the expected output, by position, and the annotations which ended the
+// expected output end the actual output.
+func (r *testDataReader) restoreInlineComments(expected, actual string) string {
+	if r.opts.inlineComments == "" {
+		return actual
+	}
+	// comments[i] holds the annotations which preceded the i-th line.
+	comments := make(map[int][]string)
+	n := 0
+	for _, line := range strings.Split(strings.TrimSuffix(expected, "\n"), "\n") {
+		if r.isInlineComment(line) {
+			comments[n] = append(comments[n], line)
+		} else {
+			n++
+		}
+	}
+	if len(comments) == 0 {
+		return actual
+	}
+	var lines []string
+	if actual != "" {
+		lines = strings.Split(strings.TrimSuffix(actual, "\n"), "\n")
+	}
+	var buf strings.Builder
+	// The annotations which ended the expected output end the actual output.
+	trailing := comments[n]
+	delete(comments, n)
+	for i, line := range lines {
+		for _, c := range comments[i] {
+			buf.WriteString(c + "\n")
+		}
+		delete(comments, i)
+		buf.WriteString(line + "\n")
+	}
+	// Emit the annotations for the lines which no longer exist in their
+	// original order.
+	rest := make([]int, 0, len(comments))
+	for i := range comments {
+		rest = append(rest, i)
+	}
+	sort.Ints(rest)
+	for _, i := range rest {
+		for _, c := range comments[i] {
+			buf.WriteString(c + "\n")
+		}
+	}
+	for _, c := range trailing {
+		buf.WriteString(c + "\n")
+	}
+	return buf.String()
+}
+
+// goRuntimeRedactions are the replacements made by ScrubGoRuntime.
+var goRuntimeRedactions = []Redaction{
+	{Re: regexp.MustCompile(`0x[0-9a-fA-F]+`), Repl: "0x<addr>"},
+	{Re: regexp.MustCompile(`(\.go):\d+`), Repl: "$1:<line>"},
+}
+
+// ScrubGoRuntime replaces the parts of an output which typically vary between
+// builds of a Go program, like memory addresses and offsets (0x1f) and the
+// line numbers of source files (foo.go:12), with stable placeholders (0x<addr>
+// and foo.go:<line>). This is useful for outputs containing stack traces or
+// formatted pointers.
+func ScrubGoRuntime(s string) string {
+	for _, red := range goRuntimeRedactions {
+		s = red.Re.ReplaceAllString(s, red.Repl)
+	}
+	return s
+}
+
+// GoRuntimeRedactions returns the replacements made by ScrubGoRuntime, for use
+// with the Redactions option.
+func GoRuntimeRedactions() []Redaction {
+	return append([]Redaction(nil), goRuntimeRedactions...)
+}
+
+// isIgnored returns true if the expected results of the directive consist of
+// the IgnorePlaceholder.
+func (r *testDataReader) isIgnored(d *TestData) bool {
+	p := r.opts.ignorePlaceholder
+	return p != "" && strings.TrimSpace(d.Expected) == p
+}
+
+// recordOutput remembers the actual output of a directive with a label or
+// store meta-argument, so that later directives can refer to it.
+func (r *testDataReader) recordOutput(d *TestData, actual string) {
+	for _, key := range []string{"label", "store"} {
+		if name, ok := d.metaValue(key); ok {
+			if r.outputs == nil {
+				r.outputs = make(map[string]string)
+			}
+			r.outputs[name] = actual
+		}
+	}
+}
+
+// recall implements TestData.Recall.
+func (r *testDataReader) recall(name string) (string, bool) {
+	output, ok := r.outputs[name]
+	return output, ok
+}
+
+// backRefRe matches a line of an expected block which stands for the output of
+// an earlier directive with the given label.
+var backRefRe = regexp.MustCompile(`^\s*@same-as\(([^)]*)\)\s*$`)
+
+// expandBackRefs returns the expected output of the directive with the
+// @same-as back-references replaced by the output they refer to.
+func (r *testDataReader) expandBackRefs(d *TestData) (string, error) {
+	if !strings.Contains(d.Expected, "@same-as(") {
+		return d.Expected, nil
+	}
+	if r.parallel() {
+		return "", fmt.Errorf("@same-as cannot be used with ParallelDirectives")
+	}
+	var buf strings.Builder
+	for _, line := range strings.SplitAfter(d.Expected, "\n") {
+		m := backRefRe.FindStringSubmatch(strings.TrimSuffix(line, "\n"))
+		if m == nil {
+			buf.WriteString(line)
+			continue
+		}
+		output, ok := r.outputs[m[1]]
+		if !ok {
+			return "", fmt.Errorf("no earlier directive with label=%s", m[1])
+		}
+		buf.WriteString(output)
+	}
+	return buf.String(), nil
+}
+
+// mismatch returns the failure message for an actual output that doesn't
+// match the expected output.
+func mismatch(d *TestData, expected, actual string) string {
+	expectedLines := difflib.SplitLines(expected)
+	actualLines := difflib.SplitLines(actual)
+	if len(expectedLines) > 5 {
+		// Print a unified diff if there is a lot of output to compare.
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			Context: 5,
+			A:       expectedLines,
+			B:       actualLines,
+		})
+		if err == nil {
+			if useColor() {
+				diff = colorizeDiff(diff)
+			}
+			return fmt.Sprintf("\n%s:\n %s\noutput didn't match expected:\n%s",
+				showPos(d.Pos), d.Input, diff)
+		}
+	}
+	return fmt.Sprintf("\n%s:\n %s\nexpected:\n%s\nfound:\n%s",
+		showPos(d.Pos), d.Input, expected, actual)
+}
+
+// useColor returns true if diffs should be colorized, which is the case when
+// stdout is a terminal, unless the NO_COLOR environment variable is set (see
+// https://no-color.org).
+func useColor() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	finfo, err := os.Stdout.Stat()
+	return err == nil && finfo.Mode()&os.ModeCharDevice != 0
+}
+
+// The escape sequences used to color diffs.
+const (
+	red   = "\x1b[31m"
+	green = "\x1b[32m"
+	reset = "\x1b[0m"
+)
+
+// colorizeDiff colors the removed and added lines of a unified diff in red and
+// green, respectively.
+func colorizeDiff(diff string) string {
+	var buf strings.Builder
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		content := strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "-"):
+			buf.WriteString(red + content + reset + line[len(content):])
+		case strings.HasPrefix(line, "+"):
+			buf.WriteString(green + content + reset + line[len(content):])
+		default:
+			buf.WriteString(line)
+		}
+	}
+	return buf.String()
+}
+
+// uncolorizeDiff removes the colors added by colorizeDiff, if any, for
+// failures which are not shown in a terminal, like the diffs of Results.
+func uncolorizeDiff(diff string) string {
+	var buf strings.Builder
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		content := strings.TrimSuffix(line, "\n")
+		if (strings.HasPrefix(content, red+"-") || strings.HasPrefix(content, green+"+")) &&
+			strings.HasSuffix(content, reset) {
+			// The red and green sequences have the same length.
+			buf.WriteString(strings.TrimSuffix(content[len(red):], reset) + line[len(content):])
+		} else {
+			buf.WriteString(line)
+		}
+	}
+	return buf.String()
+}
+
+// checkContains verifies that each non-blank line of the expected output
+// occurs (or, if contains is false, does not occur) in the actual output.
+func checkContains(d *TestData, expected, actual string, contains bool) string {
+	var bad []string
+	for _, line := range strings.Split(expected, "\n") {
+		if strings.TrimSpace(line) != "" && strings.Contains(actual, line) != contains {
+			bad = append(bad, line)
+		}
+	}
+	if len(bad) == 0 {
+		return ""
+	}
+	what := "missing from"
+	if !contains {
+		what = "unexpectedly found in"
+	}
+	return fmt.Sprintf("\n%s:\n %s\nlines %s output:\n%s\nfound:\n%s",
+		showPos(d.Pos), d.Input, what, strings.Join(bad, "\n"), actual)
+}
+
+// alternativeMarker is the line which separates the alternatives of the
+// expected output of a directive with the one-of meta-argument.
+const alternativeMarker = "---- or"
+
+// splitAlternatives returns the alternatives of an expected output.
+func splitAlternatives(expected string) []string {
+	var alts []string
+	var buf strings.Builder
+	for _, line := range strings.SplitAfter(expected, "\n") {
+		if strings.TrimSpace(line) == alternativeMarker {
+			alts = append(alts, buf.String())
+			buf.Reset()
+			continue
+		}
+		buf.WriteString(line)
+	}
+	return append(alts, buf.String())
+}
+
+// checkOneOf verifies that the actual output is identical to one of the
+// alternatives of the expected output.
+func checkOneOf(d *TestData, expected, actual string) string {
+	for _, alt := range splitAlternatives(expected) {
+		if alt == actual {
+			return ""
+		}
+	}
+	return fmt.Sprintf("\n%s:\n %s\nexpected one of:\n%s\nfound:\n%s",
+		showPos(d.Pos), d.Input, expected, actual)
+}
+
+// matchesAlternative returns true if the actual output of a directive with the
+// one-of meta-argument is identical to one of its expected alternatives.
+func (r *testDataReader) matchesAlternative(d *TestData, actual string) bool {
+	expected := r.normalize(d.Cmd, r.stripInlineComments(d.Expected))
+	return checkOneOf(d, expected, actual) == ""
+}
+
+// checkMultiset verifies that the actual output has the same lines as the
+// expected output, the same number of times each, in any order.
+func checkMultiset(d *TestData, expected, actual string) string {
+	expectedCounts := countLines(expected)
+	actualCounts := countLines(actual)
+	var bad []string
+	for line, n := range expectedCounts {
+		if actualCounts[line] != n {
+			bad = append(bad, line)
+		}
+	}
+	for line := range actualCounts {
+		if _, ok := expectedCounts[line]; !ok {
+			bad = append(bad, line)
+		}
+	}
+	if len(bad) == 0 {
+		return ""
+	}
+	sort.Strings(bad)
+	var buf strings.Builder
+	for _, line := range bad {
+		fmt.Fprintf(&buf, "%q: expected %d, found %d\n", line, expectedCounts[line], actualCounts[line])
+	}
+	return fmt.Sprintf("\n%s:\n %s\nline counts didn't match expected:\n%sfound:\n%s",
+		showPos(d.Pos), d.Input, buf.String(), actual)
+}
+
+// checkTolerance verifies that the actual output has the same
+// whitespace-separated tokens as the expected output, except that numbers
+// only need to be within the given tolerance of each other. NaN and infinite
+// numbers must match exactly.
+func checkTolerance(d *TestData, tol float64, expected, actual string) string {
+	expectedTokens, actualTokens := strings.Fields(expected), strings.Fields(actual)
+	if len(expectedTokens) != len(actualTokens) {
+		return mismatch(d, expected, actual)
+	}
+	for i := range expectedTokens {
+		if expectedTokens[i] == actualTokens[i] {
+			continue
+		}
+		e, err1 := strconv.ParseFloat(expectedTokens[i], 64)
+		a, err2 := strconv.ParseFloat(actualTokens[i], 64)
+		if err1 != nil || err2 != nil || !withinTolerance(e, a, tol) {
+			return mismatch(d, expected, actual)
+		}
+	}
+	return ""
+}
+
+// withinTolerance returns whether two numbers are within the given tolerance
+// of each other. NaN only matches NaN, and infinities only match themselves.
+func withinTolerance(e, a, tol float64) bool {
+	switch {
+	case math.IsNaN(e) || math.IsNaN(a):
+		return math.IsNaN(e) && math.IsNaN(a)
+	case math.IsInf(e, 0) || math.IsInf(a, 0):
+		return e == a
+	}
+	return math.Abs(e-a) <= tol
+}
+
+// countLines returns the number of occurrences of each line of an output.
+func countLines(output string) map[string]int {
+	counts := make(map[string]int)
+	for _, line := range splitLines(output) {
+		counts[line]++
+	}
+	return counts
+}
+
+// splitLines returns the lines of an output, without their final newlines.
+func splitLines(output string) []string {
+	if output == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+}
+
+// sortLines returns the output with its lines sorted, as written for
+// directives with the multiset meta-argument when rewriting.
+func sortLines(output string) string {
+	lines := splitLines(output)
+	if len(lines) == 0 {
+		return output
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// hashOutput returns the SHA-256 digest of the actual output of a directive
+// with the hash=sha256 meta-argument, the only supported algorithm.
+func hashOutput(actual string) string {
+	return fmt.Sprintf("%x\n", sha256.Sum256([]byte(actual)))
+}
+
+// hasMetaFlag returns true if the directive has the given meta-argument
+// without a value.
+func (td *TestData) hasMetaFlag(name string) bool {
+	arg, ok := td.Arg(name)
+	return ok && len(arg.Vals) == 0
+}
+
+// metaValue returns the value of the given meta-argument, which must have
+// exactly one value.
+func (td *TestData) metaValue(name string) (string, bool) {
+	arg, ok := td.Arg(name)
+	if !ok || len(arg.Vals) != 1 {
+		return "", false
+	}
+	return arg.Vals[0], true
+}
+
+// The following functions return the value of a meta-argument if it has the
+// type the framework expects. Arguments with other values are not
+// meta-arguments, and are left to the handler.
+
+// metaUint returns the value of the given meta-argument as a non-negative
+// integer.
+func (td *TestData) metaUint(name string) (uint64, bool) {
+	val, ok := td.metaValue(name)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(val, 10, 64)
+	return n, err == nil
+}
+
+// metaFloat returns the value of the given meta-argument as a non-negative
+// number.
+func (td *TestData) metaFloat(name string) (float64, bool) {
+	val, ok := td.metaValue(name)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	return f, err == nil && f >= 0
+}
+
+// metaDuration returns the value of the given meta-argument as a duration.
+func (td *TestData) metaDuration(name string) (time.Duration, bool) {
+	val, ok := td.metaValue(name)
+	if !ok {
+		return 0, false
+	}
+	dur, err := time.ParseDuration(val)
+	return dur, err == nil
+}
@@ -15,17 +15,28 @@
 package datadriven
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/pmezard/go-difflib/difflib"
 )
@@ -38,12 +49,63 @@ var (
 			"diffs carefully!",
 	)
 
+	rewriteSubTest = flag.String(
+		"rewrite-subtest", "",
+		"combined with -rewrite, only rewrite the expected results of the directives in the "+
+			"subtest with this (full) name, including its nested subtests. The other directives "+
+			"still run, but their expected results are kept as they are.",
+	)
+
 	quietLog = flag.Bool(
 		"datadriven-quiet", false,
 		"avoid echoing the directives and responses from test files.",
 	)
+
+	onlyDirective = flag.Int(
+		"datadriven-directive", 0,
+		"if positive, run only the Nth (1-based) directive in each test file and skip the "+
+			"others. Useful to debug a single failing directive in a large file. Cannot be "+
+			"combined with -rewrite.",
+	)
+
+	allowBreakpoints = flag.Bool(
+		"datadriven-allow-breakpoints", false,
+		"stop in the debugger before invoking the function for the directives with the breakpoint "+
+			"meta-argument, which are ignored otherwise. Only use under a debugger such as "+
+			"Delve: without one, the breakpoint crashes the test binary.",
+	)
+
+	checkTestFiles = flag.Bool(
+		"datadriven-check", false,
+		"regenerate the test files as with -rewrite, but instead of writing them, fail the tests "+
+			"whose files are not up to date, showing the differences. Useful to check in CI "+
+			"that the test files were rewritten. Directives with the retry meta-argument are "+
+			"retried as usual. Cannot be combined with -rewrite or -datadriven-directive.",
+	)
+
+	walkGlob = flag.String(
+		"datadriven-glob", "",
+		"if set, Walk only processes the files whose path relative to the walked directory "+
+			"matches this pattern (see filepath.Match), and skips the others.",
+	)
 )
 
+// PosTransform is applied to the positions of directives (see TestData.Pos)
+// when they are shown in failures and logs. It can be set, typically in
+// TestMain, to map the paths of test files in CI environments, where the source
+// tree is relocated, back to paths relative to the repository. The default
+// leaves the positions unchanged. Unlike the FormatPos option, it doesn't
+// affect TestData.Pos itself.
+var PosTransform = func(pos string) string { return pos }
+
+// showPos returns the given position as shown in failures and logs.
+func showPos(pos string) string {
+	if PosTransform == nil {
+		return pos
+	}
+	return PosTransform(pos)
+}
+
 // Verbose returns true iff -datadriven-quiet was not passed.
 func Verbose() bool {
 	return testing.Verbose() && !*quietLog
@@ -88,6 +150,10 @@ func init() {
 //	----
 //	----
 //
+// A line of the expected results consisting of a separator preceded by a
+// backslash, like \----, stands for the separator itself. This is how lines of
+// actual results which look like separators are written when rewriting.
+//
 // To execute data-driven tests, pass the path of the test file as well as a
 // function which can interpret and execute whatever commands are present in
 // the test file. The framework invokes the function, passing it information
@@ -111,23 +177,118 @@ func init() {
 //
 // It is also possible for a test to report an _unexpected_ test
 // error by calling t.Error().
-func RunTest(t *testing.T, path string, f func(t *testing.T, d *TestData) string) {
+//
+// The behavior of the framework can be customized by passing Options.
+//
+// A few arguments, called meta-arguments, are interpreted by the framework
+// itself and change how the actual results are checked. They remain visible
+// to the function in CmdArgs:
+//   - contains: every line of the expected results must occur somewhere in
+//     the actual results, instead of requiring an exact match.
+//   - not-contains: no line of the expected results may occur in the actual
+//     results.
+//   - multiset: the actual results must consist of the same lines as the
+//     expected results, each occurring the same number of times, in any
+//     order. The actual results are written with their lines sorted when
+//     rewriting.
+//   - label=<name>: the actual results are remembered under the given name. A
+//     line of the form @same-as(<name>) in the expected results of a later
+//     directive stands for these results. Such lines are kept when rewriting
+//     as long as they match the actual results.
+//   - store=<name>: the actual results are remembered under the given name,
+//     for later directives to retrieve with TestData.Recall.
+//   - expect-same-as=<name>: the actual results must be identical to those of
+//     the earlier directive with label=<name>, and the expected results are
+//     ignored (and left untouched when rewriting). This is useful for
+//     equivalence tests.
+//   - retry: the function is invoked repeatedly, with a backoff, until the
+//     actual results are as expected or the duration given by the timeout
+//     argument (10s by default) elapses. When rewriting, the function is
+//     invoked only once.
+//   - assert-allocs=<n>: the test fails if the function makes more than n
+//     heap allocations, in addition to checking its actual results. The
+//     function is invoked twice, as a warm-up so that one-time initializations
+//     are not counted, and then to count the allocations, so it must be
+//     idempotent. The allocations of other goroutines running at the same
+//     time, like those of parallel tests, are counted too. This is not
+//     checked when rewriting.
+//   - silent: the function must return an empty string. Such a directive
+//     doesn't need expected results: without a "----" separator, its input
+//     ends at the first blank line.
+//   - max-duration=<d>: the test fails if the function takes longer than the
+//     given duration, like 50ms, in addition to checking its actual results.
+//     This is not checked when rewriting. With assert-allocs, only the
+//     invocation whose allocations are counted is timed.
+//   - echo-input: the actual results are preceded by the input, which is
+//     useful for tests of formatters. The function may replace d.Input with a
+//     normalized version of it beforehand. This applies both when checking and
+//     when rewriting, so the expected results must include the input too.
+//   - table: the actual and expected results are compared as tables, cell by
+//     cell, regardless of alignment. Cells are delimited by pipes if there
+//     are any, and by whitespace otherwise; borders made of '-', '+' and '='
+//     are ignored, but rows of "-" cells are kept. The actual results are
+//     written as an aligned table, without borders, when rewriting.
+//   - tolerance=<x>: the actual results must consist of the same
+//     whitespace-separated tokens as the expected results, but tokens which
+//     are numbers only need to be within x of each other, as in
+//     tolerance=1e-6. This accommodates floating-point differences across
+//     platforms. NaN and infinite numbers must match exactly.
+//   - knownfail: the actual results are expected not to match the expected
+//     results, as for a known bug. The test fails once they match, as a
+//     reminder to remove the argument, and the mismatch is logged otherwise.
+//     The expected results are left untouched when rewriting.
+//   - matrix-<key>=(<val>, ...): the function is invoked once per
+//     combination of the values of the matrix arguments, with the matrix
+//     arguments replaced by <key>=<val> arguments, and the actual results are
+//     the concatenated results of the invocations, each preceded by a header
+//     line listing its combination, like [a=1 b=x].
+//   - one-of: the actual results must be identical to one of the
+//     alternatives given in the expected results, separated by lines
+//     consisting of "---- or". This suits results with bounded
+//     nondeterminism, like two valid orderings. When rewriting, the expected
+//     results are kept if the actual results match an alternative; otherwise
+//     they are replaced, or completed with an alternative with the
+//     AppendAlternatives option.
+//   - tail=<n>: only the last n lines of the actual results are compared
+//     with the expected results, and recorded when rewriting. This leaves out
+//     verbose preambles when only a summary matters.
+//   - breakpoint: with -datadriven-allow-breakpoints, the program stops in
+//     the debugger right before the function is invoked. This is ignored
+//     otherwise.
+//   - hash=sha256: the expected results are the hex-encoded SHA-256 digest of
+//     the actual results, which is what is recorded when rewriting. This keeps
+//     test files small when the actual results are large, at the expense of
+//     readability: a mismatch only shows that the results changed.
+//
+// The keys of the meta-arguments are reserved, and handlers should avoid
+// giving them another meaning. Meta-arguments with a value, like tail=<n>, are
+// only interpreted when the value has the expected form (a number for tail,
+// sha256 for hash, a duration for max-duration, and so on); otherwise the
+// argument is left to the function. Meta-arguments without a value are always
+// interpreted, and some of them, like silent, also change how the test file is
+// parsed.
+//
+// Expected results of directives using contains or not-contains are left
+// untouched when rewriting.
+//
+// If the expected results of a directive are "[ignore]" (see
+// IgnorePlaceholder), the function is invoked but its actual results are not
+// checked, and the placeholder is kept when rewriting.
+func RunTest(
+	t *testing.T, path string, f func(t *testing.T, d *TestData) string, opts ...Option,
+) {
 	t.Helper()
 
 	RunTestAny(t, path, func(t testing.TB, d *TestData) string {
 		return f(t.(*testing.T), d)
-	})
+	}, opts...)
 }
 
 // RunTestAny is like RunTest but works over a testing.TB.
-func RunTestAny(t testing.TB, path string, f func(t testing.TB, d *TestData) string) {
-	mode := os.O_RDONLY
-	if *rewriteTestFiles {
-		// We only open read-write if rewriting, so as to enable running
-		// tests on read-only copies of the source tree.
-		mode = os.O_RDWR
-	}
-	file, err := os.OpenFile(path, mode, 0644 /* irrelevant */)
+func RunTestAny(
+	t testing.TB, path string, f func(t testing.TB, d *TestData) string, opts ...Option,
+) {
+	file, err := os.Open(path)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -141,33 +302,343 @@ func RunTestAny(t testing.TB, path string, f func(t testing.TB, d *TestData) str
 		t.Fatalf("%s is a directory, not a file; consider using datadriven.Walk", path)
 	}
 
-	rewriteData := runTestInternal(t, path, file, f, *rewriteTestFiles)
-	if *rewriteTestFiles {
-		if _, err := file.WriteAt(rewriteData, 0); err != nil {
+	if *checkTestFiles && *rewriteTestFiles {
+		t.Fatalf("-datadriven-check cannot be combined with -rewrite")
+	}
+
+	if *docDir != "" {
+		if *rewriteTestFiles {
+			t.Fatalf("-datadriven-doc cannot be combined with -rewrite")
+		}
+		if err := writeDoc(t, path, file, opts...); err != nil {
 			t.Fatal(err)
 		}
-		if err := file.Truncate(int64(len(rewriteData))); err != nil {
+		return
+	}
+
+	if *rewriteTestFiles && makeOptions(opts).rewriteSink == nil {
+		rewriteFile(t, path, file, finfo.Mode().Perm(), f, opts...)
+		return
+	}
+
+	var input io.Reader = file
+	var original []byte
+	if *rewriteTestFiles {
+		// Remember the original contents, so that files that don't change are
+		// not written to the sink.
+		if original, err = ioutil.ReadAll(file); err != nil {
 			t.Fatal(err)
 		}
-		if err := file.Sync(); err != nil {
+		input = bytes.NewReader(original)
+	}
+
+	rewriteData := runTestInternal(t, path, input, f, *rewriteTestFiles, opts...)
+	if *rewriteTestFiles && !bytes.Equal(rewriteData, original) {
+		if err := writeToSink(makeOptions(opts).rewriteSink(path), rewriteData); err != nil {
 			t.Fatal(err)
 		}
 	}
 }
 
+// writeToSink writes the rewritten contents of a test file to the writer
+// returned by the RewriteSink function, and closes it.
+func writeToSink(w io.WriteCloser, data []byte) error {
+	if _, err := w.Write(data); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// rewriteFile runs the test file with -rewrite, and atomically replaces it
+// with the rewritten contents, so that an interrupted rewrite never leaves a
+// truncated file behind. The rewritten contents are streamed to a temporary
+// file in the same directory as they are produced, which avoids holding them
+// in memory, and the temporary file is then renamed over the test file. Files
+// that don't change are not replaced (which would needlessly update their
+// mtime). If the test file is a symlink, its target is replaced.
+func rewriteFile(
+	t testing.TB,
+	path string,
+	file *os.File,
+	perm os.FileMode,
+	f func(t testing.TB, d *TestData) string,
+	opts ...Option,
+) {
+	t.Helper()
+	// Rewrite the target of a symlinked test file, as in Bazel runfiles trees,
+	// rather than replacing the link with a regular file. Directives are still
+	// reported under the given path.
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The temporary file is hidden, so that Walk ignores it.
+	tmp, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".rewrite-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// This fails harmlessly once the file has been renamed.
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	w := bufio.NewWriter(tmp)
+	opts = append(opts[:len(opts):len(opts)], func(o *options) { o.rewriteOut = w })
+	runTestInternal(t, path, file, f, true /* rewrite */, opts...)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Close the test file before replacing it: on Windows, open files cannot
+	// be replaced.
+	_ = file.Close()
+
+	if same, err := sameContents(target, tmp.Name()); err != nil {
+		t.Fatal(err)
+	} else if same {
+		return
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sameContents returns true if the files at the given paths have the same
+// contents. The files are compared in chunks, without reading them whole.
+func sameContents(path1, path2 string) (bool, error) {
+	f1, err := os.Open(path1)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f1.Close() }()
+	f2, err := os.Open(path2)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f2.Close() }()
+
+	r1, r2 := bufio.NewReader(f1), bufio.NewReader(f2)
+	buf1, buf2 := make([]byte, 32<<10), make([]byte, 32<<10)
+	for {
+		n1, err1 := io.ReadFull(r1, buf1)
+		n2, err2 := io.ReadFull(r2, buf2)
+		if !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+		eof1 := err1 == io.EOF || err1 == io.ErrUnexpectedEOF
+		eof2 := err2 == io.EOF || err2 == io.ErrUnexpectedEOF
+		if eof1 || eof2 {
+			return eof1 && eof2, nil
+		}
+		if err1 != nil {
+			return false, err1
+		}
+		if err2 != nil {
+			return false, err2
+		}
+	}
+}
+
+// RunTestE is like RunTest but accepts a function that can also return an
+// error. If the error is non-nil, the actual output of the case is the error
+// message prefixed by "error: " and any string returned alongside it is
+// ignored. This avoids formatting errors into the output string in every
+// handler.
+func RunTestE(
+	t *testing.T, path string, f func(t *testing.T, d *TestData) (string, error), opts ...Option,
+) {
+	t.Helper()
+	RunTest(t, path, func(t *testing.T, d *TestData) string {
+		return errorOutput(f(t, d))
+	}, opts...)
+}
+
+// errorOutput returns the actual output for a handler that returned the given
+// output and error.
+func errorOutput(output string, err error) string {
+	if err != nil {
+		return fmt.Sprintf("error: %s", err)
+	}
+	return output
+}
+
+// ParseTestData parses the test file contents read from r into its
+// directives, in order, without running them. Subtest directives are included.
+// This is meant for tools like linters or documentation generators. If the
+// contents are malformed, the error is a *ParseError.
+func ParseTestData(name string, r io.Reader, opts ...Option) (directives []TestData, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			pf, ok := r.(parseFailure)
+			if !ok {
+				panic(r)
+			}
+			directives, err = nil, pf.err
+		}
+	}()
+	var rep errorReporter
+	reader := newTestDataReader(rep, name, r, false /* record */, makeOptions(opts))
+	for reader.Next(rep) {
+		directives = append(directives, reader.data)
+	}
+	return directives, nil
+}
+
+// CountDirectives returns the number of directives in the test file contents
+// read from r, not counting subtest directives. This allows guarding against
+// accidental deletions of test cases, with a test like:
+//
+//	func TestDirectiveCount(t *testing.T) {
+//	  f, err := os.Open("testdata/foo")
+//	  if err != nil {
+//	    t.Fatal(err)
+//	  }
+//	  defer f.Close()
+//	  if n, err := datadriven.CountDirectives("testdata/foo", f); err != nil {
+//	    t.Fatal(err)
+//	  } else if n < 42 {
+//	    t.Fatalf("expected at least 42 directives, found %d", n)
+//	  }
+//	}
+func CountDirectives(name string, r io.Reader) (int, error) {
+	directives, err := ParseTestData(name, r)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, d := range directives {
+		if d.Cmd != "subtest" {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ParseForFuzz parses arbitrary bytes as the contents of a test file, like
+// ParseTestData. Malformed inputs result in an error rather than a panic,
+// which makes it suitable for use in Go fuzz targets, for example:
+//
+//	func FuzzParse(f *testing.F) {
+//	  f.Fuzz(func(t *testing.T, data []byte) {
+//	    _, _ = datadriven.ParseForFuzz(data)
+//	  })
+//	}
+func ParseForFuzz(data []byte) (directives []TestData, parseErr error) {
+	return ParseTestData("<fuzz>", bytes.NewReader(data))
+}
+
+// errorReporter is a Reporter which panics with a parseFailure.
+type errorReporter struct{}
+
+// parseFailure is the panic value used by errorReporter.
+type parseFailure struct {
+	err error
+}
+
+func (errorReporter) Helper() {}
+
+func (errorReporter) Fatalf(format string, args ...interface{}) {
+	if len(args) == 1 {
+		if err, ok := args[0].(*ParseError); ok {
+			panic(parseFailure{err: err})
+		}
+	}
+	panic(parseFailure{err: fmt.Errorf(format, args...)})
+}
+
+// CheckFile parses the test file contents read from input and verifies the
+// results returned by f for each directive against the expected results, using
+// the same rules as RunTest. Unlike RunTest, it does not depend on the testing
+// package: errors are reported through rep. Subtest directives are ignored and
+// the test file is never rewritten.
+func CheckFile(
+	rep Reporter, sourceName string, input io.Reader, f func(d *TestData) string, opts ...Option,
+) {
+	rep.Helper()
+	r := newTestDataReader(rep, sourceName, input, false /* record */, makeOptions(opts))
+	for r.Next(rep) {
+		d := &r.data
+		if d.Cmd == "subtest" {
+			continue
+		}
+		r.preprocessInput(d)
+		actual := withTrailingNewline(r.normalize(d.Cmd, f(d)))
+		if d.variants != nil && d.activeVariant < 0 {
+			rep.Fatalf("%s: none of the conditional expected blocks applies to the active keys",
+				showPos(d.Pos))
+		}
+		if d.noExpected {
+			// Nothing to check, as with the OptionalSeparator option.
+		} else if failure := r.checkExpected(d, actual); failure != "" {
+			rep.Fatalf("%s", failure)
+		}
+		r.recordOutput(d, actual)
+	}
+}
+
+// withTrailingNewline adds a final newline to a non-empty output if it doesn't
+// have one already.
+func withTrailingNewline(output string) string {
+	if output != "" && !strings.HasSuffix(output, "\n") {
+		output += "\n"
+	}
+	return output
+}
+
 // RunTestFromString is a version of RunTest which takes the contents of a test
 // directly.
-func RunTestFromString(t *testing.T, input string, f func(t *testing.T, d *TestData) string) {
+func RunTestFromString(
+	t *testing.T, input string, f func(t *testing.T, d *TestData) string, opts ...Option,
+) {
 	t.Helper()
 	RunTestFromStringAny(t, input, func(t testing.TB, d *TestData) string {
 		return f(t.(*testing.T), d)
-	})
+	}, opts...)
 }
 
 // RunTestFromStringAny is like RunTestFromString but works with a testing.TB.
-func RunTestFromStringAny(t testing.TB, input string, f func(t testing.TB, d *TestData) string) {
+func RunTestFromStringAny(
+	t testing.TB, input string, f func(t testing.TB, d *TestData) string, opts ...Option,
+) {
 	t.Helper()
-	runTestInternal(t, "<string>" /* sourceName */, strings.NewReader(input), f, *rewriteTestFiles)
+	runTestInternal(
+		t, "<string>" /* sourceName */, strings.NewReader(input), f, *rewriteTestFiles, opts...,
+	)
+}
+
+// RunDirective runs a single directive, given with its input and expected
+// results as in a test file, and returns its actual results. The actual
+// results are checked against the expected results as with RunTest, but the
+// directive is never rewritten. This is convenient to test handlers in
+// isolation, without a test file:
+//
+//	out := datadriven.RunDirective(t, "eval\n1 + 2\n----\n3\n", handler)
+func RunDirective(
+	t *testing.T, directive string, f func(t *testing.T, d *TestData) string, opts ...Option,
+) string {
+	t.Helper()
+	r := newTestDataReader(
+		t, "<string>", strings.NewReader(directive), false /* record */, makeOptions(opts),
+	)
+	if !r.Next(t) || r.data.Cmd == "subtest" {
+		t.Fatalf("no directive found in %q", directive)
+	}
+	if _, ok := r.data.Peek(); ok {
+		t.Fatalf("%s: more than one directive found in %q", showPos(r.data.Pos), directive)
+	}
+	return runDirective(t, r, &r.data, func(t testing.TB, d *TestData) string {
+		return f(t.(*testing.T), d)
+	})
 }
 
 func runTestInternal(
@@ -176,12 +647,77 @@ func runTestInternal(
 	reader io.Reader,
 	f func(t testing.TB, d *TestData) string,
 	rewrite bool,
+	opts ...Option,
 ) (rewriteOutput []byte) {
 	t.Helper()
 
-	r := newTestDataReader(t, sourceName, reader, rewrite)
-	for r.Next(t) {
-		runDirectiveOrSubTest(t, r, "" /*mandatorySubTestPrefix*/, f)
+	if *onlyDirective > 0 && rewrite {
+		t.Fatalf("-datadriven-directive cannot be combined with -rewrite")
+	}
+	if *rewriteSubTest != "" && !*rewriteTestFiles {
+		t.Fatalf("-rewrite-subtest requires -rewrite")
+	}
+
+	// With -datadriven-check, the file is regenerated as with -rewrite, but the
+	// result is only compared with the original contents.
+	var original *bytes.Buffer
+	if *checkTestFiles && !rewrite {
+		if *onlyDirective > 0 {
+			t.Fatalf("-datadriven-directive cannot be combined with -datadriven-check")
+		}
+		original = new(bytes.Buffer)
+		reader = io.TeeReader(reader, original)
+		rewrite = true
+	}
+
+	o := makeOptions(opts)
+	if o.preprocessFile != nil {
+		if rewrite {
+			t.Fatalf("%s: the PreprocessFile option cannot be combined with -rewrite", sourceName)
+		}
+		contents, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		processed, err := o.preprocessFile(sourceName, string(contents))
+		if err != nil {
+			t.Fatalf("%s: %v", sourceName, err)
+		}
+		reader = strings.NewReader(processed)
+	}
+	if o.setupFile != "" {
+		runSetup(t, o.setupFile, f, o)
+	}
+	r := newTestDataReader(t, sourceName, reader, rewrite, o)
+	r.check = original != nil
+	// Parallel directives are copied, so their expected results can't be
+	// loaded later.
+	r.lazyExpected = o.lazyExpected && !rewrite && !r.parallel()
+	// The flags are not parsed outside of tests, as with ClearResults, and
+	// Verbose panics then.
+	if start := time.Now(); flag.Parsed() && Verbose() {
+		// The summary is logged from a cleanup, even if the test fails, so that
+		// it is attributed to the caller rather than to the runtime.
+		var elapsed time.Duration
+		defer func() { elapsed = time.Since(start) }()
+		t.Cleanup(func() {
+			t.Helper()
+			r.logSummary(t, elapsed)
+		})
+	}
+	if r.parallel() {
+		// Parallel subtests only run once the function of their parent test
+		// has returned. Group them in a subtest, so that they have finished
+		// when the caller's deferred cleanups run.
+		subTest(t, "parallel", func(t testing.TB) {
+			for r.Next(t) {
+				runDirectiveOrSubTest(t, r, "" /*mandatorySubTestPrefix*/, f)
+			}
+		})
+	} else {
+		for r.Next(t) {
+			runDirectiveOrSubTest(t, r, "" /*mandatorySubTestPrefix*/, f)
+		}
 	}
 
 	if r.rewrite != nil {
@@ -190,11 +726,68 @@ func runTestInternal(
 		if l := len(data); l > 2 && data[l-1] == '\n' && data[l-2] == '\n' {
 			data = data[:l-1]
 		}
+		if original != nil {
+			checkUpToDate(t, sourceName, original.String(), string(data))
+			return nil
+		}
+		if r.opts.rewriteOut != nil {
+			if _, err := r.opts.rewriteOut.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			return nil
+		}
 		return data
 	}
 	return nil
 }
 
+// checkUpToDate fails the test if the contents of a test file differ from its
+// contents regenerated with -datadriven-check, showing the differences.
+func checkUpToDate(t testing.TB, sourceName, original, regenerated string) {
+	t.Helper()
+	if original == regenerated {
+		return
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(original),
+		B:        difflib.SplitLines(regenerated),
+		FromFile: sourceName,
+		ToFile:   sourceName + " (rewritten)",
+		Context:  3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if useColor() {
+		diff = colorizeDiff(diff)
+	}
+	t.Fatalf("%s: test file is not up to date (run with -rewrite to update it):\n%s", sourceName, diff)
+}
+
+// runSetup runs the directives of the setup file given with the Setup option,
+// without checking their results.
+func runSetup(t testing.TB, path string, f func(t testing.TB, d *TestData) string, o options) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	r := newTestDataReader(t, path, file, false /* record */, o)
+	for r.Next(t) {
+		if r.data.Cmd == "subtest" {
+			continue
+		}
+		r.preprocessInput(&r.data)
+		_ = r.callHandler(t, &r.data, f)
+		if t.Failed() {
+			t.FailNow()
+		}
+	}
+}
+
 // runDirectiveOrSubTest runs either a "subtest" directive or an
 // actual test directive. The "mandatorySubTestPrefix" argument indicates
 // a mandatory prefix required from all sub-test names at this point.
@@ -207,8 +800,12 @@ func runDirectiveOrSubTest(
 	t.Helper()
 	if subTestName, ok := isSubTestStart(t, r, mandatorySubTestPrefix); ok {
 		runSubTest(subTestName, t, r, f)
+	} else if *onlyDirective > 0 && r.directiveCount != *onlyDirective {
+		// Only a single directive was requested with -datadriven-directive.
+	} else if r.parallel() && len(r.subTests) == 0 {
+		runParallelDirective(t, r, f)
 	} else {
-		runDirective(t, r, f)
+		runDirective(t, r, &r.data, f)
 	}
 	if t.Failed() {
 		// If a test has failed with .Error(), we can't expect any
@@ -242,6 +839,9 @@ func runSubTest(
 	testingSubTestName := subTestName[strings.LastIndex(subTestName, "/")+1:]
 
 	// Begin the sub-test.
+	r.subTests = append(r.subTests, openSubTest{name: subTestName, pos: subTestStartPos})
+	defer func() { r.subTests = r.subTests[:len(r.subTests)-1] }()
+
 	subTest(t, testingSubTestName, func(t testing.TB) {
 		defer func() {
 			// Skips are signalled using Goexit() so we must catch it /
@@ -251,6 +851,14 @@ func runSubTest(
 			}
 		}()
 
+		if r.opts.onSubTestStart != nil {
+			r.opts.onSubTestStart(subTestName)
+		}
+		if r.opts.onSubTestEnd != nil {
+			// The hook also runs if the subtest fails.
+			defer r.opts.onSubTestEnd(subTestName)
+		}
+
 		for r.Next(t) {
 			if isSubTestEnd(t, r) {
 				seenSubTestEnd = true
@@ -269,41 +877,68 @@ func runSubTest(
 		//   for the skipped sub-test, while proceeding to rewrite for
 		//   non-skipped tests.
 		r.data.Fatalf(t,
-			"cannot use t.Skip inside subtest\n%s: subtest started here", subTestStartPos)
-	}
-
-	if seenSubTestEnd && len(r.data.CmdArgs) == 2 && r.data.CmdArgs[1].Key != subTestName {
-		// If a subtest name was provided after "subtest end", ensure that it matches.
-		r.data.Fatalf(t,
-			"mismatched subtest end directive: expected %q, got %q", r.data.CmdArgs[1].Key, subTestName)
+			"cannot use t.Skip inside subtest\n%s: subtest started here", showPos(subTestStartPos))
 	}
 
 	if !seenSubTestEnd && !t.Failed() {
 		// We only report missing "subtest end" if there was no error otherwise;
 		// for if there was an error, the reading would have stopped.
-		r.data.Fatalf(t,
-			"EOF encountered without subtest end directive\n%s: subtest started here", subTestStartPos)
+		r.data.Fatalf(t, "EOF encountered without subtest end directive for %q\n%s: subtest started here",
+			subTestName, showPos(subTestStartPos))
 	}
+}
 
+// openSubTest describes a subtest whose "subtest end" directive has not been
+// read yet.
+type openSubTest struct {
+	// name is the full path to the subtest.
+	name string
+	// pos is the position of the opening subtest directive.
+	pos string
 }
 
 func isSubTestStart(t testing.TB, r *testDataReader, mandatorySubTestPrefix string) (string, bool) {
 	if r.data.Cmd != "subtest" {
 		return "", false
 	}
+	if len(r.data.CmdArgs) > 0 && r.data.CmdArgs[0].Key == "end" {
+		r.data.Fatalf(t, "subtest end without corresponding start")
+	}
 	if len(r.data.CmdArgs) != 1 {
 		r.data.Fatalf(t, "invalid syntax for subtest")
 	}
 	subTestName := r.data.CmdArgs[0].Key
-	if subTestName == "end" {
-		r.data.Fatalf(t, "subtest end without corresponding start")
-	}
 	if !strings.HasPrefix(subTestName, mandatorySubTestPrefix) {
-		r.data.Fatalf(t, "name of nested subtest must begin with %q", mandatorySubTestPrefix)
+		parent := r.subTests[len(r.subTests)-1]
+		r.data.Fatalf(t, "subtest %q cannot be nested in subtest %q, whose nested subtests must "+
+			"begin with %q; is a subtest end directive missing?\n%s: subtest %q started here",
+			subTestName, parent.name, mandatorySubTestPrefix, showPos(parent.pos), parent.name)
+	}
+	if sanitized, ok := sanitizeSubTestName(subTestName); !ok {
+		msg := fmt.Sprintf("subtest name %q contains characters that are rewritten by the "+
+			"testing package or interpreted by go test -run; consider using %q instead",
+			subTestName, sanitized)
+		if r.opts.strictSubTestNames {
+			r.data.Fatalf(t, "%s", msg)
+		}
+		t.Logf("%s: %s", showPos(r.data.Pos), msg)
 	}
 	return subTestName, true
 }
 
+// sanitizeSubTestName replaces the characters in a (slash-separated) subtest
+// name which make it hard to target the subtest with go test -run. The second
+// return value is true if the name didn't need to be changed.
+func sanitizeSubTestName(name string) (string, bool) {
+	sanitized := unsafeSubTestNameRe.ReplaceAllString(name, "_")
+	return sanitized, sanitized == name
+}
+
+// unsafeSubTestNameRe matches characters that the testing package rewrites in
+// test names (spaces and non-printable characters), as well as regexp
+// metacharacters other than '.', which mostly matches itself.
+var unsafeSubTestNameRe = regexp.MustCompile(`[\s\p{C}\\^$|?*+()\[\]{}]`)
+
 func isSubTestEnd(t testing.TB, r *testDataReader) bool {
 	if r.data.Cmd != "subtest" {
 		return false
@@ -314,33 +949,58 @@ func isSubTestEnd(t testing.TB, r *testDataReader) bool {
 	if len(r.data.CmdArgs) > 2 {
 		r.data.Fatalf(t, "invalid syntax for subtest end")
 	}
+	if len(r.data.CmdArgs) == 2 {
+		// If a subtest name was provided after "subtest end", ensure that it
+		// matches the innermost open subtest.
+		innermost := r.subTests[len(r.subTests)-1]
+		if name := r.data.CmdArgs[1].Key; name != innermost.name {
+			r.data.Fatalf(t, "mismatched subtest end directive: expected %q, got %q\n"+
+				"%s: subtest %q started here", innermost.name, name, showPos(innermost.pos), innermost.name)
+		}
+	}
 	return true
 }
 
-// runDirective runs just one directive in the input.
+// runDirective runs just one directive in the input, and returns its actual
+// output.
 //
 // The stopNow and subTestSkipped booleans are modified by-reference
 // instead of returned because the testing module implements t.Skip
 // and t.Fatal using panics, and we're not guaranteed to get back to
 // the caller via a return in those cases.
-func runDirective(t testing.TB, r *testDataReader, f func(testing.TB, *TestData) string) {
+func runDirective(
+	t testing.TB, r *testDataReader, d *TestData, f func(testing.TB, *TestData) string,
+) string {
 	t.Helper()
 
-	d := &r.data
-	actual := func() string {
-		defer func() {
-			if r := recover(); r != nil {
-				t.Logf("\npanic during %s:\n%s\n", d.Pos, d.Input)
-				panic(r)
-			}
-		}()
-		actual := f(t, d)
-		if actual != "" && !strings.HasSuffix(actual, "\n") {
-			actual += "\n"
+	// Report a failed Result for the directive if it doesn't get to report its
+	// result, as when the handler or one of the checks below fails the test.
+	reported := false
+	defer func() {
+		if !reported && !t.Skipped() {
+			r.reportResult(Result{Pos: d.Pos, Cmd: d.Cmd})
 		}
-		return actual
 	}()
 
+	r.preprocessInput(d)
+	var actual string
+	var elapsed time.Duration
+	if limit, ok := d.metaUint("assert-allocs"); ok && r.rewrite == nil {
+		actual, elapsed = r.callHandlerWithAllocLimit(t, d, f, limit)
+	} else {
+		start := time.Now()
+		actual = r.callHandler(t, d, f)
+		elapsed = time.Since(start)
+	}
+	if budget, ok := d.metaDuration("max-duration"); ok && r.rewrite == nil {
+		checkDuration(t, d, budget, elapsed)
+	}
+	if d.hasMetaFlag("retry") && (r.rewrite == nil || r.check) {
+		// With -datadriven-check, retry until the results match the file.
+		d.ExpectedString()
+		actual = retryHandler(t, r, d, f, actual)
+	}
+
 	if t.Failed() {
 		// If the test has failed with .Error(), then we can't hope it
 		// will have produced a useful actual output. Trying to do
@@ -352,46 +1012,289 @@ func runDirective(t testing.TB, r *testDataReader, f func(testing.TB, *TestData)
 		t.FailNow()
 	}
 
+	r.collectOutput(d, actual)
+
+	// The handler has succeeded, the expected results are needed now.
+	d.ExpectedString()
+
 	// The test has not failed, we can analyze the expected
 	// output.
-	if r.rewrite != nil {
-		r.emit("----")
-		if hasBlankLine(actual) {
-			r.emit("----")
-			r.rewrite.WriteString(actual)
-			r.emit("----")
-			r.emit("----")
-			r.emit("")
+	if d.variants != nil && d.activeVariant < 0 {
+		d.Fatalf(t, "none of the conditional expected blocks applies to the active keys")
+	}
+	if r.opts.rejectTabs {
+		// When rewriting, the expected results are about to be replaced.
+		rejectTabs(t, d, actual, r.rewrite == nil /* checkExpected */)
+	}
+	if d.hasMetaFlag("silent") && actual != "" {
+		d.Fatalf(t, "expected no output from silent directive, found:\n%s", actual)
+	}
+	if d.noExpected {
+		// Nothing to check or rewrite.
+	} else if r.rewrite != nil {
+		if d.hasMetaFlag("multiset") {
+			// Write the lines in a canonical order.
+			r.emitExpected(d, sortLines(actual))
+		} else if d.hasMetaFlag("table") {
+			r.emitExpected(d, renderTable(actual))
+		} else if d.hasMetaFlag("one-of") && r.opts.appendAlternatives && d.Expected != "" &&
+			!r.matchesAlternative(d, actual) {
+			r.emitExpected(d, d.Expected+alternativeMarker+"\n"+actual)
 		} else {
-			// Here actual already ends in \n so emit adds a blank line.
-			r.emit(actual)
-		}
-	} else if d.Expected != actual {
-		expectedLines := difflib.SplitLines(d.Expected)
-		actualLines := difflib.SplitLines(actual)
-		if len(expectedLines) > 5 {
-			// Print a unified diff if there is a lot of output to compare.
-			diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
-				Context: 5,
-				A:       expectedLines,
-				B:       actualLines,
-			})
-			if err == nil {
-				t.Fatalf("\n%s:\n %s\noutput didn't match expected:\n%s", d.Pos, d.Input, diff)
-				return
-			}
-			t.Logf("Failed to produce diff %v", err)
+			r.emitExpected(d, actual)
 		}
-		t.Fatalf("\n%s:\n %s\nexpected:\n%s\nfound:\n%s", d.Pos, d.Input, d.Expected, actual)
+	} else if d.hasMetaFlag("knownfail") {
+		failure := r.checkExpected(d, actual)
+		if failure == "" {
+			d.Fatalf(t, "directive marked knownfail produced the expected output; "+
+				"remove the knownfail argument")
+		}
+		t.Logf("%s: known failure:%s", showPos(d.Pos), failure)
+	} else if failure := r.checkExpected(d, actual); failure != "" {
+		reported = true
+		r.reportResult(Result{Pos: d.Pos, Cmd: d.Cmd, Diff: uncolorizeDiff(failure)})
+		// The hint only helps if -rewrite would replace the expected results.
+		if !r.opts.noRewriteHint && !r.preserveExpected(d, actual) {
+			failure += "\n(run with -rewrite to update the expected output)"
+		}
+		t.Fatal(failure)
 	} else if Verbose() {
 		input := d.Input
 		if input == "" {
 			input = "<no input to command>"
 		}
 		// TODO(tbg): it's awkward to reproduce the args, but it would be helpful.
-		t.Logf("\n%s:\n%s [%d args]\n%s\n----\n%s", d.Pos, d.Cmd, len(d.CmdArgs), input, actual)
+		t.Logf("\n%s:\n%s [%d args]\n%s\n----\n%s", showPos(d.Pos), d.Cmd, len(d.CmdArgs), input, actual)
+	}
+	reported = true
+	r.reportResult(Result{Pos: d.Pos, Cmd: d.Cmd, Passed: true})
+	if !r.parallel() {
+		r.recordOutput(d, actual)
+	}
+	return actual
+}
+
+// runParallelDirective runs the current directive in its own parallel
+// subtest, when using the ParallelDirectives option. The subtest runs after
+// the rest of the file has been read.
+func runParallelDirective(t testing.TB, r *testDataReader, f func(testing.TB, *TestData) string) {
+	// Copy the directive, since the reader reuses r.data.
+	d := r.data
+	subTest(t, fmt.Sprintf("%d_%s", r.directiveCount, d.Cmd), func(t testing.TB) {
+		if p, ok := t.(interface{ Parallel() }); ok {
+			p.Parallel()
+		}
+		runDirective(t, r, &d, f)
+	})
+}
+
+// callHandler invokes the handler for a directive and returns its output,
+// after applying the Redactions for the command and IgnoreLinePrefixes. The
+// output is preceded by the input of the directive if it has the echo-input
+// meta-argument, or replaced by its digest if it has the hash meta-argument.
+func (r *testDataReader) callHandler(
+	t testing.TB, d *TestData, f func(testing.TB, *TestData) string,
+) string {
+	t.Helper()
+	defer func() {
+		if r := recover(); r != nil {
+			t.Logf("\npanic during %s:\n%s\n", showPos(d.Pos), d.Input)
+			panic(r)
+		}
+	}()
+	if *allowBreakpoints && d.hasMetaFlag("breakpoint") {
+		t.Logf("%s: breakpoint", showPos(d.Pos))
+		runtime.Breakpoint()
+	}
+	var output string
+	if hasMatrixArgs(d) {
+		output = runMatrix(t, d, f)
+	} else {
+		output = f(t, d)
+	}
+	actual := withTrailingNewline(r.normalize(d.Cmd, output))
+	if n, ok := d.metaUint("tail"); ok {
+		actual = tailLines(actual, n)
+	}
+	if d.hasMetaFlag("echo-input") && d.Input != "" {
+		// Use d.Input after invoking the handler, which may have normalized it.
+		actual = d.Input + "\n" + actual
+	}
+	if algo, ok := d.metaValue("hash"); ok && algo == "sha256" {
+		actual = hashOutput(actual)
+	}
+	return actual
+}
+
+// tailLines returns the last n lines of an output, for the tail=<n>
+// meta-argument. The whole output is returned if it has fewer lines.
+func tailLines(output string, n uint64) string {
+	lines := strings.SplitAfter(output, "\n")
+	// The output ends with a newline, so the last element is empty.
+	if uint64(len(lines)-1) <= n {
+		return output
+	}
+	return strings.Join(lines[len(lines)-1-int(n):], "")
+}
+
+// matrixArgPrefix starts the keys of the arguments of a directive which is run
+// once per combination of their values.
+const matrixArgPrefix = "matrix-"
+
+// hasMatrixArgs returns true if the directive has matrix-<key> arguments.
+func hasMatrixArgs(d *TestData) bool {
+	for _, arg := range d.CmdArgs {
+		if strings.HasPrefix(arg.Key, matrixArgPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// runMatrix invokes the handler for a directive with matrix-<key> arguments
+// once per combination of their values, and returns the concatenated outputs,
+// each preceded by a header listing its combination. For each invocation, the
+// matrix-<key> arguments are replaced by <key>=<value> arguments. The first
+// matrix argument varies the slowest.
+func runMatrix(t testing.TB, d *TestData, f func(testing.TB, *TestData) string) string {
+	t.Helper()
+	combos := [][]CmdArg{nil}
+	for _, arg := range d.CmdArgs {
+		if !strings.HasPrefix(arg.Key, matrixArgPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(arg.Key, matrixArgPrefix)
+		if key == "" || len(arg.Vals) == 0 {
+			d.Fatalf(t, "%s: a matrix argument needs a key and values", arg.Key)
+		}
+		var next [][]CmdArg
+		for _, combo := range combos {
+			for _, val := range arg.Vals {
+				c := append(combo[:len(combo):len(combo)], CmdArg{Key: key, Vals: []string{val}})
+				next = append(next, c)
+			}
+		}
+		combos = next
+	}
+
+	var buf strings.Builder
+	for _, combo := range combos {
+		cd := *d
+		cd.CmdArgs = make([]CmdArg, 0, len(d.CmdArgs))
+		header := make([]string, len(combo))
+		i := 0
+		for _, arg := range d.CmdArgs {
+			if strings.HasPrefix(arg.Key, matrixArgPrefix) {
+				arg = combo[i]
+				header[i] = arg.String()
+				i++
+			}
+			cd.CmdArgs = append(cd.CmdArgs, arg)
+		}
+		fmt.Fprintf(&buf, "[%s]\n", strings.Join(header, " "))
+		buf.WriteString(withTrailingNewline(f(t, &cd)))
+	}
+	return buf.String()
+}
+
+// callHandlerWithAllocLimit is like callHandler, but fails the test if the
+// handler allocates more than the limit given by the assert-allocs
+// meta-argument. It also returns the time taken by the handler, not counting
+// the warm-up invocations made by measureAllocs.
+func (r *testDataReader) callHandlerWithAllocLimit(
+	t testing.TB, d *TestData, f func(testing.TB, *TestData) string, max uint64,
+) (string, time.Duration) {
+	t.Helper()
+	var allocs uint64
+	var elapsed time.Duration
+	// With matrix arguments, the handler is invoked once per combination.
+	actual := r.callHandler(t, d, func(t testing.TB, d *TestData) (res string) {
+		n, took := measureAllocs(func() { res = f(t, d) })
+		allocs += n
+		elapsed += took
+		return res
+	})
+	if allocs > max {
+		d.Fatalf(t, "handler made %d allocations, more than assert-allocs=%d", allocs, max)
 	}
-	return
+	return actual, elapsed
+}
+
+// rejectTabs fails the test if the actual results of the directive, or its
+// expected results if checkExpected is set, contain tabs, when using the
+// RejectTabs option.
+func rejectTabs(t testing.TB, d *TestData, actual string, checkExpected bool) {
+	t.Helper()
+	for _, block := range []struct{ name, text string }{
+		{"expected", d.Expected}, {"actual", actual},
+	} {
+		if block.name == "expected" && !checkExpected {
+			continue
+		}
+		for i, line := range strings.Split(block.text, "\n") {
+			if strings.Contains(line, "\t") {
+				d.Fatalf(t, "line %d of the %s results contains a tab; please use spaces: %q",
+					i+1, block.name, line)
+			}
+		}
+	}
+}
+
+// checkDuration fails the test if the time taken by the handler exceeds the
+// budget given by the max-duration meta-argument.
+func checkDuration(t testing.TB, d *TestData, max, elapsed time.Duration) {
+	t.Helper()
+	if elapsed > max {
+		d.Fatalf(t, "handler took %s, more than max-duration=%s", elapsed, max)
+	}
+}
+
+// measureAllocs returns the number of heap allocations made by fn, and the
+// time it took. Like testing.AllocsPerRun, it invokes fn once first as a
+// warm-up, so that lazy initializations are not counted. Unlike it, it leaves
+// GOMAXPROCS alone, which would affect the tests running in parallel.
+func measureAllocs(fn func()) (uint64, time.Duration) {
+	fn()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	fn()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	return after.Mallocs - before.Mallocs, elapsed
+}
+
+// defaultRetryTimeout is the time for which a directive with the retry
+// meta-argument is retried if no timeout argument is specified.
+const defaultRetryTimeout = 10 * time.Second
+
+// retryHandler re-invokes the handler of a directive with the retry
+// meta-argument until its output is as expected or the timeout elapses. It
+// returns the most recent output.
+func retryHandler(
+	t testing.TB, r *testDataReader, d *TestData, f func(testing.TB, *TestData) string, actual string,
+) string {
+	t.Helper()
+	timeout, ok := d.metaDuration("timeout")
+	if !ok {
+		timeout = defaultRetryTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for backoff := time.Millisecond; r.checkExpected(d, actual) != ""; backoff *= 2 {
+		remaining := time.Until(deadline)
+		if remaining <= 0 || t.Failed() {
+			break
+		}
+		if backoff > time.Second {
+			backoff = time.Second
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		time.Sleep(backoff)
+		actual = r.callHandler(t, d, f)
+	}
+	return actual
 }
 
 // Walk goes through all the files in a subdirectory, creating subtests to match
@@ -419,38 +1322,181 @@ func runDirective(t testing.TB, r *testDataReader, f func(testing.TB, *TestData)
 //
 // If path is "testdata", the function is called three times, in subtest
 // hierarchy /typing, /logprops/scan, /logprops/select.
-func Walk(t *testing.T, path string, f func(t *testing.T, path string)) {
+//
+// The behavior of Walk can be customized by passing WalkOptions.
+func Walk(t *testing.T, path string, f func(t *testing.T, path string), opts ...WalkOption) {
 	t.Helper()
 	WalkAny(t, path, func(t testing.TB, path string) {
 		f(t.(*testing.T), path)
-	})
+	}, opts...)
 }
 
 // WalkAny is like Walk but works over a testing.TB.
-func WalkAny(t testing.TB, path string, f func(t testing.TB, path string)) {
+func WalkAny(t testing.TB, path string, f func(t testing.TB, path string), opts ...WalkOption) {
+	w := walker{
+		root: path,
+		leaf: func(t testing.TB, path string, _ interface{}) { f(t, path) },
+		opts: makeWalkOptions(opts),
+	}
+	w.walk(t, path, nil /* state */)
+}
+
+// WalkWithState is like Walk, but allows per-directory state (for example a
+// shared fixture) to be computed once and handed to every leaf below it.
+//
+// When descending into a directory (including path itself, if it is a
+// directory), enter is called with the state of the enclosing directory (nil
+// at the top) and returns the state for that directory. Each leaf file is
+// passed the state of the directory containing it. Once all entries of a
+// directory have been processed, exit is called with that directory's state,
+// even if a test below it failed. Either enter or exit may be nil; if enter is
+// nil, directories inherit the state of their parent.
+func WalkWithState(
+	t *testing.T,
+	path string,
+	enter func(t *testing.T, dir string, parent interface{}) interface{},
+	exit func(t *testing.T, dir string, state interface{}),
+	f func(t *testing.T, path string, state interface{}),
+	opts ...WalkOption,
+) {
+	t.Helper()
+	w := walker{root: path, opts: makeWalkOptions(opts)}
+	if enter != nil {
+		w.enter = func(t testing.TB, dir string, parent interface{}) interface{} {
+			return enter(t.(*testing.T), dir, parent)
+		}
+	}
+	if exit != nil {
+		w.exit = func(t testing.TB, dir string, state interface{}) {
+			exit(t.(*testing.T), dir, state)
+		}
+	}
+	w.leaf = func(t testing.TB, path string, state interface{}) {
+		f(t.(*testing.T), path, state)
+	}
+	w.walk(t, path, nil /* state */)
+}
+
+// WalkWithStateAny is like WalkWithState but works over a testing.TB.
+func WalkWithStateAny(
+	t testing.TB,
+	path string,
+	enter func(t testing.TB, dir string, parent interface{}) interface{},
+	exit func(t testing.TB, dir string, state interface{}),
+	f func(t testing.TB, path string, state interface{}),
+	opts ...WalkOption,
+) {
+	w := walker{root: path, enter: enter, exit: exit, leaf: f, opts: makeWalkOptions(opts)}
+	w.walk(t, path, nil /* state */)
+}
+
+// walker holds the callbacks used to walk a directory hierarchy.
+type walker struct {
+	// root is the path passed to Walk.
+	root  string
+	enter func(t testing.TB, dir string, parent interface{}) interface{}
+	exit  func(t testing.TB, dir string, state interface{})
+	leaf  func(t testing.TB, path string, state interface{})
+	opts  walkOptions
+}
+
+// walk processes the file or directory at path. The state argument is the
+// state of the enclosing directory.
+func (w *walker) walk(t testing.TB, path string, state interface{}) {
 	finfo, err := os.Stat(path)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !finfo.IsDir() {
-		f(t, path)
+	if !finfo.IsDir() || (w.opts.isLeaf != nil && w.opts.isLeaf(path, finfo)) {
+		if w.matchesGlobs(t, path) {
+			w.callLeaf(t, path, state)
+		}
 		return
 	}
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if w.enter != nil {
+		state = w.enter(t, path, state)
+	}
+	if w.exit != nil {
+		defer w.exit(t, path, state)
+	}
+	// Detect files whose names differ only by case, which can't coexist on
+	// case-insensitive file systems, so that tests behave the same everywhere.
+	seen := make(map[string]string, len(files))
+	for _, file := range files {
+		if tempFileRe.MatchString(file.Name()) || w.opts.skip[file.Name()] {
+			continue
+		}
+		name := strings.ToLower(file.Name())
+		if other, ok := seen[name]; ok {
+			t.Fatalf("%s: files %q and %q differ only by case, which case-insensitive file "+
+				"systems don't support; please rename one of them", path, other, file.Name())
+		}
+		seen[name] = file.Name()
+	}
 	for _, file := range files {
 		if tempFileRe.MatchString(file.Name()) {
 			// Temp or hidden file, don't even try processing.
 			continue
 		}
+		if w.opts.skip[file.Name()] {
+			// Setup file, which RunTest runs before each test file. Only the one
+			// at the root is passed to the Setup option, so other ones would
+			// silently not run.
+			if path != w.root {
+				t.Fatalf("%s: setup file %q is only supported at the root of the walk, %s",
+					path, file.Name(), w.root)
+			}
+			continue
+		}
 		subTest(t, cutExt(file.Name()), func(t testing.TB) {
-			WalkAny(t, filepath.Join(path, file.Name()), f)
+			w.walk(t, filepath.Join(path, file.Name()), state)
 		})
 	}
 }
 
+// callLeaf calls the function registered for the leaf at path with
+// WalkHandler, if any, or the walk function otherwise.
+func (w *walker) callLeaf(t testing.TB, path string, state interface{}) {
+	for _, h := range w.opts.handlers {
+		if h.match(path) {
+			h.fn(t, path)
+			return
+		}
+	}
+	w.leaf(t, path, state)
+}
+
+// matchesGlobs returns true if the leaf at path matches the pattern given by
+// -datadriven-glob and the Glob option, if any. Patterns are matched against
+// the path relative to the root of the walk, or against the file name if the
+// root is the leaf itself.
+func (w *walker) matchesGlobs(t testing.TB, path string) bool {
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel == "." {
+		rel = filepath.Base(path)
+	}
+	for _, pattern := range []string{*walkGlob, w.opts.glob} {
+		if pattern == "" {
+			continue
+		}
+		ok, err := filepath.Match(pattern, rel)
+		if err != nil {
+			t.Fatalf("invalid glob pattern %q: %v", pattern, err)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
 // cutExt returns the given file name with the extension removed, if there is
 // one.
 func cutExt(fileName string) string {
@@ -494,6 +1540,10 @@ type TestData struct {
 	// inclusion in logs and error messages.
 	Pos string
 
+	// File is the path of the test file, as passed to RunTest, or "<string>"
+	// for tests run with RunTestFromString. It is unaffected by FormatPos.
+	File string
+
 	// Cmd is the first string on the directive line (up to the first whitespace).
 	Cmd string
 
@@ -508,10 +1558,98 @@ type TestData struct {
 	// output.
 	// This field is provided so that a test can perform an early return
 	// with "return d.Expected" to signal that nothing has changed.
+	//
+	// If non-empty, Expected always ends in a newline, even if the last line of
+	// the test file doesn't. This mirrors the normalization of actual results,
+	// to which a final newline is added if missing.
+	//
+	// With the LazyExpected option, Expected is only set once the handler has
+	// returned; handlers must use ExpectedString instead, including to return
+	// the expected results unchanged.
 	Expected string
 
-	// Rewrite is set if the test is being run with the -rewrite flag.
+	// Rewrite is set if the actual results are being recorded instead of
+	// verified, as is the case with the -rewrite flag. Handlers can use it to
+	// skip expensive cross-checks that only matter during verification.
 	Rewrite bool
+
+	// UserData is the value passed with the UserData option, if any.
+	UserData interface{}
+
+	// rawExpected contains the lines of the expected block as they appeared in
+	// the test file, used to preserve the block when rewriting.
+	rawExpected []string
+
+	// noExpected is set for directives without expected results, when using
+	// the OptionalSeparator option. Their results are not checked.
+	noExpected bool
+
+	// variants contains the expected blocks of a directive with conditional
+	// expected results, and activeVariant is the index of the block that
+	// applies (or -1 if none does). Expected and rawExpected are those of the
+	// active block.
+	variants      []expectedVariant
+	activeVariant int
+
+	// argFiles contains the contents of the files named by arguments, by
+	// argument name, when using the FileArgs option.
+	argFiles map[string][]byte
+
+	// inputPos implements InputLinePos. It is nil if the directive has no
+	// input.
+	inputPos func(line int) string
+	// loadExpected, if set, reads the expected results from the test file; see
+	// LazyExpected.
+	loadExpected func()
+	// peek implements Peek.
+	peek func() (cmd string, ok bool)
+	// recall implements Recall.
+	recall func(name string) (output string, ok bool)
+}
+
+// Peek returns the command of the directive following this one in the test
+// file, without consuming it. The second return value is false if this is the
+// last directive. This allows handlers to implement constructs spanning
+// several directives. Peek is not meaningful with ParallelDirectives.
+func (td *TestData) Peek() (cmd string, ok bool) {
+	if td.peek == nil {
+		return "", false
+	}
+	return td.peek()
+}
+
+// InputLinePos returns the position in the test file of the given line of the
+// input of the directive, numbered from 1, in the same format as Pos. This lets
+// handlers which validate their input report errors at the offending line, as
+// in d.InputLinePos(i+1) for the line d.InputLines()[i]. It returns Pos if the
+// directive has no input.
+func (td *TestData) InputLinePos(lineInInput int) string {
+	if td.inputPos == nil {
+		return td.Pos
+	}
+	return td.inputPos(lineInInput)
+}
+
+// ExpectedString returns the expected results of the directive, as in
+// Expected. With the LazyExpected option, they are read from the test file on
+// the first call.
+func (td *TestData) ExpectedString() string {
+	if td.loadExpected != nil {
+		td.loadExpected()
+	}
+	return td.Expected
+}
+
+// Recall returns the actual output of the most recent earlier directive of
+// the test file with the meta-argument store=<name> (or label=<name>). The
+// second return value is false if there is no such directive. Stored outputs
+// are forgotten at the end of the test file; they are recorded when rewriting
+// too. Recall is not meaningful with ParallelDirectives.
+func (td *TestData) Recall(name string) (output string, ok bool) {
+	if td.recall == nil {
+		return "", false
+	}
+	return td.recall(name)
 }
 
 // HasArg checks whether the CmdArgs array contains an entry for the given key.
@@ -520,6 +1658,14 @@ func (td *TestData) HasArg(key string) bool {
 	return ok
 }
 
+// ForEachArg calls fn with each of the arguments of the directive, in order.
+// This suits handlers which treat the arguments as an ordered list.
+func (td *TestData) ForEachArg(fn func(arg CmdArg)) {
+	for _, arg := range td.CmdArgs {
+		fn(arg)
+	}
+}
+
 // Arg retrieves the first CmdArg matching the given key. The second return
 // value indicates whether such an argument exists.
 func (td *TestData) Arg(key string) (arg CmdArg, ok bool) {
@@ -531,6 +1677,14 @@ func (td *TestData) Arg(key string) (arg CmdArg, ok bool) {
 	return arg, false
 }
 
+// ArgFile returns the contents of the file named by the given argument, which
+// must have been registered with the FileArgs option. The second return value
+// is false if the directive has no such argument.
+func (td *TestData) ArgFile(key string) ([]byte, bool) {
+	data, ok := td.argFiles[key]
+	return data, ok
+}
+
 // MaybeScanArgs behaves identically to ScanArgs, except that if the arg does
 // not exist it leaves the destinations unmodified and returns false. In all
 // other cases it returns true.
@@ -559,36 +1713,140 @@ func (td *TestData) MaybeScanArgs(t testing.TB, key string, dests ...interface{}
 //	td.ScanArgs(t, "arg1", &i1)
 //	td.ScanArgs(t, "arg2", &s)
 //	td.ScanArgs(t, "arg3", &i2, &i3, &i4)
+//
+// A destination of type *[]byte is decoded from hex digits if the value has a
+// 0x prefix (as in data=0xdeadbeef), from base64 if it has a base64: prefix,
+// and is the value itself otherwise.
+//
+// Destinations of other types, like pointers to structs, can be scanned from
+// values with a prefix registered with RegisterValueScanner. For example, after
+// importing the yamlscan package, values of the form yaml:<document> are
+// unmarshaled from the YAML document, which is typically quoted with the
+// QuotedArgs option:
+//
+//	cmd cfg="yaml:{name: foo, sizes: [1, 2]}"
+//
+// A destination can also be a pointer to a pointer to one of the supported
+// types, for optional arguments: the pointer is allocated if the arg exists,
+// and set to nil otherwise. A missing arg is not an error if all destinations
+// are of this kind. For example, the following leaves limit nil unless the
+// directive has a limit argument:
+//
+//	var limit *int
+//	td.ScanArgs(t, "limit", &limit)
 func (td *TestData) ScanArgs(t testing.TB, key string, dests ...interface{}) {
 	t.Helper()
 	arg, ok := td.Arg(key)
 	if !ok {
+		if len(dests) > 0 && allOptional(dests) {
+			for _, dest := range dests {
+				v := reflect.ValueOf(dest).Elem()
+				v.Set(reflect.Zero(v.Type()))
+			}
+			return
+		}
 		td.Fatalf(t, "missing argument: %s", key)
 	}
 	arg.scan(t, td.Pos, dests...)
 }
 
+// ScanRune returns the single value of the argument with the given key as a
+// rune. The value can be a character other than a digit, which stands for
+// itself, a quoted character (as in c='7' or c='\n'), or a code point (as in
+// c=U+0041, c=0x41 or c=65). A lone digit is ambiguous and fails; the character
+// 7 is written as '7', U+0037 or 0x37. Since rune is an alias for int32,
+// ScanArgs scans a *rune destination as an integer instead.
+func (td *TestData) ScanRune(t testing.TB, key string) rune {
+	t.Helper()
+	arg, ok := td.Arg(key)
+	if !ok {
+		td.Fatalf(t, "missing argument: %s", key)
+	}
+	if len(arg.Vals) != 1 {
+		td.Fatalf(t, "%s: expected a single value, found %d", key, len(arg.Vals))
+	}
+	r, err := parseRune(arg.Vals[0])
+	if err != nil {
+		td.Fatalf(t, "%s: %v", key, err)
+	}
+	return r
+}
+
+// isOptional returns true if the destination is a pointer to a pointer, used
+// for optional arguments.
+func isOptional(dest interface{}) bool {
+	t := reflect.TypeOf(dest)
+	return t != nil && t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Ptr
+}
+
+func allOptional(dests []interface{}) bool {
+	for _, dest := range dests {
+		if !isOptional(dest) {
+			return false
+		}
+	}
+	return true
+}
+
+// allocOptional allocates the pointer that an optional destination points to,
+// and returns it as the destination to scan into. Other destinations are
+// returned unchanged.
+func allocOptional(dest interface{}) interface{} {
+	if !isOptional(dest) {
+		return dest
+	}
+	v := reflect.ValueOf(dest).Elem()
+	v.Set(reflect.New(v.Type().Elem()))
+	return v.Interface()
+}
+
 // CmdArg contains information about an argument on the directive line. An
 // argument is specified in one of the following forms:
 //   - argument
 //   - argument=value
 //   - argument=(values, ...)
+//
+// With the QuotedArgs option, the argument name can be quoted, as in
+// "a b"=value, to contain spaces or '='; Key holds the unquoted name, which is
+// what HasArg, Arg and ScanArgs match.
+//
+// The String method renders the argument in a form that ParseQuotedLine parses
+// back into the same argument, quoting values where necessary.
 type CmdArg struct {
 	Key  string
 	Vals []string
 }
 
 func (arg CmdArg) String() string {
+	key := quoteKey(arg.Key)
 	switch len(arg.Vals) {
 	case 0:
-		return arg.Key
+		return key
 
 	case 1:
-		return fmt.Sprintf("%s=%s", arg.Key, arg.Vals[0])
+		return fmt.Sprintf("%s=%s", key, quoteValue(arg.Vals[0], false /* inList */))
 
 	default:
-		return fmt.Sprintf("%s=(%s)", arg.Key, strings.Join(arg.Vals, ", "))
+		vals := make([]string, len(arg.Vals))
+		for i, val := range arg.Vals {
+			vals[i] = quoteValue(val, true /* inList */)
+		}
+		return fmt.Sprintf("%s=(%s)", key, strings.Join(vals, ", "))
+	}
+}
+
+// NumVals returns the number of values of the argument.
+func (arg CmdArg) NumVals() int {
+	return len(arg.Vals)
+}
+
+// Val returns the value at index i. It panics if there is no such value.
+func (arg CmdArg) Val(i int) string {
+	if i < 0 || i >= len(arg.Vals) {
+		panic(fmt.Sprintf("%s: cannot get value %d of argument with %d values",
+			arg.Key, i, len(arg.Vals)))
 	}
+	return arg.Vals[i]
 }
 
 // Scan attempts to parse the value at index i into the dest.
@@ -599,12 +1857,73 @@ func (arg CmdArg) Scan(t testing.TB, i int, dest interface{}) {
 	}
 }
 
+// ScanFrom parses the values of the argument starting at index start into the
+// given destinations, in order: dests[i] is scanned from the value at index
+// start+i. Unlike ScanArgs, the argument may have other values, before or
+// after these. It is a fatal error for a destination not to have a value.
+func (arg CmdArg) ScanFrom(t testing.TB, start int, dests ...interface{}) {
+	t.Helper()
+	if start < 0 || start+len(dests) > len(arg.Vals) {
+		t.Fatalf("%s: cannot scan values %d to %d of argument with %d values",
+			arg.Key, start, start+len(dests)-1, len(arg.Vals))
+	}
+	for i, dest := range dests {
+		if err := arg.scanScalarErr(start+i, allocOptional(dest)); err != nil {
+			t.Fatalf("%s: failed to scan argument %d: %v", arg.Key, start+i, err)
+		}
+	}
+}
+
+// ScanFlags returns the bitwise OR of the flags named by the values of the
+// argument, as in flags=(READ, WRITE), according to the given names.
+func ScanFlags[T ~uint | ~uint64](t testing.TB, arg CmdArg, names map[string]T) T {
+	t.Helper()
+	var res T
+	for _, val := range arg.Vals {
+		flag, ok := names[val]
+		if !ok {
+			valid := make([]string, 0, len(names))
+			for name := range names {
+				valid = append(valid, name)
+			}
+			sort.Strings(valid)
+			t.Fatalf("%s: unknown flag %q (valid flags: %s)", arg.Key, val, strings.Join(valid, ", "))
+		}
+		res |= flag
+	}
+	return res
+}
+
+// ScanStringer parses the value at index i of the argument of directive d with
+// the given function, such as the Parse or FromString function of an enum type.
+// This supports types which don't implement encoding.TextUnmarshaler. It is a
+// fatal error, reported at the position of the directive, for the value not to
+// exist or not to parse.
+func ScanStringer[T any](
+	t testing.TB, d *TestData, arg CmdArg, i int, parse func(string) (T, error),
+) T {
+	t.Helper()
+	if i < 0 || i >= len(arg.Vals) {
+		d.Fatalf(t, "%s: cannot scan value %d of argument with %d values", arg.Key, i, len(arg.Vals))
+	}
+	res, err := parse(arg.Vals[i])
+	if err != nil {
+		d.Fatalf(t, "%s: failed to scan argument %d: %v", arg.Key, i, err)
+	}
+	return res
+}
+
 func (arg CmdArg) scan(t testing.TB, pos string, dests ...interface{}) {
+	dests = append([]interface{}(nil), dests...)
+	for i := range dests {
+		dests[i] = allocOptional(dests[i])
+	}
+
 	// If only one destination is provided, use scanAllErr which supports
 	// scanning multiple values into a slice destination type.
 	if len(dests) == 1 {
 		if err := arg.scanAllErr(dests[0]); err != nil {
-			t.Fatalf("%s: %s: failed to scan argument %d: %v", pos, arg.Key, 0, err)
+			t.Fatalf("%s: %s: failed to scan argument %d: %v", showPos(pos), arg.Key, 0, err)
 		}
 		return
 	}
@@ -615,12 +1934,13 @@ func (arg CmdArg) scan(t testing.TB, pos string, dests ...interface{}) {
 	//   td.ScanArgs(t, "arg3", &i2, &i3, &i4)
 	//
 	if len(dests) != len(arg.Vals) {
-		t.Fatalf("%s: %s: got %d destinations, but %d values", pos, arg.Key, len(dests), len(arg.Vals))
+		t.Fatalf("%s: %s: got %d destinations, but %d values",
+			showPos(pos), arg.Key, len(dests), len(arg.Vals))
 	}
 
 	for i := range dests {
 		if err := arg.scanScalarErr(i, dests[i]); err != nil {
-			t.Fatalf("%s: %s: failed to scan argument %d: %v", pos, arg.Key, i, err)
+			t.Fatalf("%s: %s: failed to scan argument %d: %v", showPos(pos), arg.Key, i, err)
 		}
 	}
 }
@@ -662,6 +1982,16 @@ func (arg CmdArg) scanAllErr(dest interface{}) error {
 			(*dest)[i] = float64(n)
 		}
 		return nil
+	case *[]time.Duration:
+		*dest = make([]time.Duration, len(arg.Vals))
+		for i := 0; i < len(arg.Vals); i++ {
+			d, err := time.ParseDuration(arg.Vals[i])
+			if err != nil {
+				return fmt.Errorf("arg %d: %w", i, err)
+			}
+			(*dest)[i] = d
+		}
+		return nil
 	}
 
 	// If there's a single value and `dest` is a supported scalar type, we might
@@ -699,6 +2029,25 @@ func (arg CmdArg) scanScalarErr(i int, dest interface{}) error {
 			return err
 		}
 		*dest = n
+	case *int32:
+		n, err := strconv.ParseInt(val, 10, 32)
+		if err != nil {
+			return err
+		}
+		*dest = int32(n)
+	case *byte:
+		// Base 0 allows prefixes like 0x to be used.
+		n, err := strconv.ParseUint(val, 0, 8)
+		if err != nil {
+			return err
+		}
+		*dest = byte(n)
+	case *[]byte:
+		b, err := parseBytes(val)
+		if err != nil {
+			return err
+		}
+		*dest = b
 	case *bool:
 		b, err := strconv.ParseBool(val)
 		if err != nil {
@@ -717,17 +2066,135 @@ func (arg CmdArg) scanScalarErr(i int, dest interface{}) error {
 			return err
 		}
 		*dest = t
+	case *big.Int:
+		// Base 0 allows prefixes like 0x to be used.
+		if _, ok := dest.SetString(val, 0); !ok {
+			return fmt.Errorf("invalid integer %q", val)
+		}
+	case *url.URL:
+		u, err := url.Parse(val)
+		if err != nil {
+			return err
+		}
+		*dest = *u
+	case flag.Value:
+		// This covers the many types which are already parseable from
+		// command-line flags.
+		return dest.Set(val)
 	default:
+		// Other types, like structs, can be handled by registered scanners.
+		if ok, err := scanRegistered(val, dest); ok {
+			return err
+		}
 		return fmt.Errorf("unsupported type %T for destination #%d (might be easy to add it)", dest, i+1)
 	}
 	return nil
 }
 
+// parseBytes parses a value scanned into a byte slice: either hex digits
+// following a 0x prefix, base64 following a base64: prefix, or else the bytes
+// of the value itself.
+func parseBytes(val string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(val, "0x"):
+		return hex.DecodeString(val[2:])
+	case strings.HasPrefix(val, "base64:"):
+		return base64.StdEncoding.DecodeString(strings.TrimPrefix(val, "base64:"))
+	default:
+		return []byte(val), nil
+	}
+}
+
+// parseRune parses a value scanned with ScanRune: either a single character
+// other than a digit, which stands for itself, a quoted character like '7' or
+// '\n', or a numeric code point, like 0x41, U+0041 or 65. A lone digit is
+// rejected as ambiguous: it must be written as '7', U+0037 or 0x37.
+func parseRune(val string) (rune, error) {
+	if r, size := utf8.DecodeRuneInString(val); size == len(val) && r != utf8.RuneError {
+		if r >= '0' && r <= '9' {
+			return 0, fmt.Errorf("%q is ambiguous between a character and a code point; "+
+				"use '%c' or U+%04X for the character", val, r, r)
+		}
+		return r, nil
+	}
+	if len(val) >= 2 && val[0] == '\'' && val[len(val)-1] == '\'' {
+		s, err := strconv.Unquote(val)
+		if err != nil {
+			return 0, fmt.Errorf("%s is not a valid quoted character", val)
+		}
+		r, _ := utf8.DecodeRuneInString(s)
+		return r, nil
+	}
+	num := val
+	base := 0
+	if strings.HasPrefix(num, "U+") {
+		num, base = num[2:], 16
+	}
+	n, err := strconv.ParseInt(num, base, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is neither a single character nor a numeric code point", val)
+	}
+	if r := rune(n); utf8.ValidRune(r) {
+		return r, nil
+	}
+	return 0, fmt.Errorf("%q is not a valid code point", val)
+}
+
 // Fatalf wraps a fatal testing error with test file position information, so
 // that it's easy to locate the source of the error.
 func (td TestData) Fatalf(tb testing.TB, format string, args ...interface{}) {
 	tb.Helper()
-	tb.Fatalf("%s: %s", td.Pos, fmt.Sprintf(format, args...))
+	tb.Fatalf("%s: %s", showPos(td.Pos), fmt.Sprintf(format, args...))
+}
+
+// RequireInputFormat fails the test if the input of the directive is not in
+// the given format. The supported formats are:
+//   - utf8: the input must be valid UTF-8.
+//   - json: the input must be a single valid JSON value.
+//
+// This is a cheap precondition check for handlers, which reports corrupted
+// inputs with the position of the directive.
+func (td *TestData) RequireInputFormat(tb testing.TB, kind string) {
+	tb.Helper()
+	switch kind {
+	case "utf8":
+		if !utf8.ValidString(td.Input) {
+			for i, line := range strings.Split(td.Input, "\n") {
+				if !utf8.ValidString(line) {
+					td.Fatalf(tb, "input line %d is not valid UTF-8: %q", i+1, line)
+				}
+			}
+		}
+	case "json":
+		var v interface{}
+		if err := json.Unmarshal([]byte(td.Input), &v); err != nil {
+			td.Fatalf(tb, "input is not valid JSON: %v", err)
+		}
+	default:
+		td.Fatalf(tb, "unsupported input format %q", kind)
+	}
+}
+
+// InputLines returns the lines of the input of the directive. It returns nil
+// if the directive has no input.
+func (td *TestData) InputLines() []string {
+	if td.Input == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(td.Input, "\n"), "\n")
+}
+
+// InputRecords returns the records of the input of the directive separated by
+// sep, for example "\n\n" for paragraphs or "\n--\n". The leading and trailing
+// newlines of each record are removed, and empty records are omitted.
+func (td *TestData) InputRecords(sep string) []string {
+	var records []string
+	for _, rec := range strings.Split(td.Input, sep) {
+		if rec = strings.Trim(rec, "\n"); rec != "" {
+			records = append(records, rec)
+		}
+	}
+	return records
 }
 
 // hasBlankLine returns true iff `s` contains at least one line that's
@@ -16,14 +16,27 @@ package datadriven
 
 import (
 	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"text/template"
 	"time"
 
 	"github.com/pmezard/go-difflib/difflib"
@@ -54,6 +67,85 @@ unknown command
 	})
 }
 
+func TestSeparatorWhitespace(t *testing.T) {
+	RunTestFromString(t, "echo\nfoo\n\t----\nfoo\n\n"+
+		"echo\nbar\n----  \nbar\n\n"+
+		"echo\nbaz\n ---- \n----\t\nbaz\n\nbaz\n----\n\t----\n",
+		func(t *testing.T, d *TestData) string {
+			if d.Input == "baz" {
+				return "baz\n\nbaz"
+			}
+			return d.Input
+		})
+}
+
+func TestEscapedSeparator(t *testing.T) {
+	RunTestFromString(t, `
+hr
+----
+\----
+
+hr many
+----
+----
+above
+\----
+
+\\----
+----
+----
+`, func(t *testing.T, d *TestData) string {
+		if d.HasArg("many") {
+			return "above\n----\n\n\\----\n"
+		}
+		return "----"
+	})
+}
+
+func TestExpectedTrailingNewline(t *testing.T) {
+	for _, input := range []string{
+		"cmd\n----\nfoo",
+		"cmd\n----\nfoo\n",
+		"cmd\n----\n----\nfoo\n----\n----",
+	} {
+		RunTestFromString(t, input, func(t *testing.T, d *TestData) string {
+			if d.Expected != "foo\n" {
+				t.Fatalf("expected %q, got %q", "foo\n", d.Expected)
+			}
+			return "foo"
+		})
+	}
+}
+
+func TestRunTestFromURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/suite" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "echo\nfoo\n----\nfoo\n")
+	}))
+	defer srv.Close()
+
+	var pos string
+	RunTestFromURL(t, srv.URL+"/suite", func(t *testing.T, d *TestData) string {
+		pos = d.Pos
+		return d.Input
+	}, HTTPClient(srv.Client()))
+	if exp := srv.URL + "/suite:1"; pos != exp {
+		t.Errorf("expected position %s, got %s", exp, pos)
+	}
+}
+
+func TestRunDirective(t *testing.T) {
+	out := RunDirective(t, "double\nfoo\n----\nfoo\nfoo\n", func(t *testing.T, d *TestData) string {
+		return d.Input + "\n" + d.Input
+	})
+	if exp := "foo\nfoo\n"; out != exp {
+		t.Errorf("expected %q, got %q", exp, out)
+	}
+}
+
 func TestParseLine(t *testing.T) {
 	RunTestFromString(t, `
 parse
@@ -70,8 +162,32 @@ parse
 xx a=b b=c c=(1,2,3)
 ----
 "xx" [a=b b=c c=(1, 2, 3)]
+
+parse-quoted
+xx "a b"=1 "c=d" "e"=(2,3) f=("g, h", ")")
+----
+"xx" ["a b"=1 "c=d" e=(2, 3) f=("g, h", ")")]
+
+parse-quoted
+xx "a"b=1
+----
+here: cannot parse directive at column 7: xx "a"b=1
+
+parse-quoted
+xx a="b
+----
+here: cannot parse directive at column 6: xx a="b
+
+parse
+xx "a b"=1 c="d" e=("f, g")
+----
+"xx" ["\"a" "b\""=1 c="\"d\"" e=("\"f", "g\"")]
 `, func(t *testing.T, d *TestData) string {
-		cmd, args, err := ParseLine(d.Input)
+		parse := ParseLine
+		if d.Cmd == "parse-quoted" {
+			parse = ParseQuotedLine
+		}
+		cmd, args, err := parse(d.Input)
 		if err != nil {
 			return fmt.Errorf("here: %w", err).Error()
 		}
@@ -79,6 +195,180 @@ xx a=b b=c c=(1,2,3)
 	})
 }
 
+func TestCmdArgStringRoundTrip(t *testing.T) {
+	for _, arg := range []CmdArg{
+		{Key: "a"},
+		{Key: "a", Vals: []string{""}},
+		{Key: "a", Vals: []string{"b"}},
+		{Key: "a", Vals: []string{"b c"}},
+		{Key: "a", Vals: []string{"(b)"}},
+		{Key: "a", Vals: []string{`"b"`}},
+		{Key: "a", Vals: []string{`b\`}},
+		{Key: "a", Vals: []string{"b\tc"}},
+		{Key: "a", Vals: []string{"b", "c"}},
+		{Key: "a", Vals: []string{"b", ""}},
+		{Key: "a", Vals: []string{"b, c", "d"}},
+		{Key: "a", Vals: []string{" b", "c "}},
+		{Key: "a", Vals: []string{"f(b, c)", "(", ")"}},
+		{Key: "a", Vals: []string{"🍌", "x=y"}},
+		{Key: "a b", Vals: []string{"c"}},
+		{Key: "a=b"},
+		{Key: `"a"`, Vals: []string{"b", "c"}},
+	} {
+		line := "cmd " + arg.String()
+		_, args, err := ParseQuotedLine(line)
+		if err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		if len(args) != 1 || !reflect.DeepEqual(args[0], arg) {
+			t.Errorf("%s: expected %#v, got %#v", line, arg, args)
+		}
+	}
+}
+
+func TestForEachArg(t *testing.T) {
+	RunTestFromString(t, `
+cmd b=1 a c=(2, 3)
+----
+b a c
+`, func(t *testing.T, d *TestData) string {
+		var keys []string
+		d.ForEachArg(func(arg CmdArg) {
+			keys = append(keys, arg.Key)
+		})
+		return strings.Join(keys, " ")
+	})
+}
+
+func TestScanBytes(t *testing.T) {
+	for val, exp := range map[string]string{
+		"0xdeadbeef":      "\xde\xad\xbe\xef",
+		"base64:aGVsbG8=": "hello",
+		"plain":           "plain",
+	} {
+		var b []byte
+		CmdArg{Key: "data", Vals: []string{val}}.Scan(t, 0, &b)
+		if string(b) != exp {
+			t.Errorf("%s: expected %q, got %q", val, exp, b)
+		}
+	}
+
+	for _, val := range []string{"0xabc", "base64:!"} {
+		var b []byte
+		if err := (CmdArg{Key: "data", Vals: []string{val}}).scanScalarErr(0, &b); err == nil {
+			t.Errorf("%s: expected error", val)
+		}
+	}
+}
+
+func TestCmdArgScanFrom(t *testing.T) {
+	arg := CmdArg{Key: "range", Vals: []string{"a", "5", "10"}}
+	var start, end int
+	arg.ScanFrom(t, 1, &start, &end)
+	if start != 5 || end != 10 {
+		t.Fatalf("expected 5 and 10, got %d and %d", start, end)
+	}
+
+	defer func() {
+		const exp = "range: cannot scan values 2 to 3 of argument with 3 values"
+		if r := recover(); r != exp {
+			t.Fatalf("expected failure %q, got %v", exp, r)
+		}
+	}()
+	arg.ScanFrom(fatalTB{t}, 2, &start, &end)
+}
+
+func TestQuotedKey(t *testing.T) {
+	RunTestFromString(t, `
+cmd "a b"=1
+----
+1
+`, func(t *testing.T, d *TestData) string {
+		var v int
+		d.ScanArgs(t, "a b", &v)
+		return fmt.Sprint(v)
+	}, QuotedArgs())
+}
+
+func TestRenderDirective(t *testing.T) {
+	args := []CmdArg{
+		{Key: "b", Vals: []string{"x y"}},
+		{Key: "a"},
+		{Key: "c", Vals: []string{"1", "2"}},
+		{Key: "a", Vals: []string{"z"}},
+	}
+	for _, tc := range []struct {
+		sortArgs bool
+		expected string
+	}{
+		{false, `cmd b="x y" a c=(1, 2) a=z`},
+		{true, `cmd a a=z b="x y" c=(1, 2)`},
+	} {
+		line := RenderDirective("cmd", args, tc.sortArgs)
+		if line != tc.expected {
+			t.Errorf("expected %q, got %q", tc.expected, line)
+		}
+		if _, parsed, err := ParseQuotedLine(line); err != nil {
+			t.Fatal(err)
+		} else if !tc.sortArgs && !reflect.DeepEqual(parsed, args) {
+			t.Errorf("%s: expected %#v, got %#v", line, args, parsed)
+		}
+	}
+}
+
+func TestCmdArgVal(t *testing.T) {
+	arg := CmdArg{Key: "a", Vals: []string{"x", "y"}}
+	if n := arg.NumVals(); n != 2 {
+		t.Fatalf("expected 2 values, got %d", n)
+	}
+	if v := arg.Val(1); v != "y" {
+		t.Fatalf("expected y, got %s", v)
+	}
+	defer func() {
+		if r := recover(); r != "a: cannot get value 2 of argument with 2 values" {
+			t.Fatalf("unexpected panic: %v", r)
+		}
+	}()
+	arg.Val(2)
+}
+
+func TestMultiLineArgsPos(t *testing.T) {
+	RunTestFromString(t, `
+pos a=(1,
+  2)
+----
+<string>:2
+`, func(t *testing.T, d *TestData) string {
+		return d.Pos
+	})
+}
+
+func TestAllowTrailingComma(t *testing.T) {
+	const input = `
+vals a=(x, y,) b=(x,) c=() d=(x, "") e=(x, , )
+----
+a=(x, y) b=x c= d=(x, "") e=(x, "")
+`
+	handler := func(t *testing.T, d *TestData) string {
+		var buf strings.Builder
+		for i, arg := range d.CmdArgs {
+			if i > 0 {
+				buf.WriteString(" ")
+			}
+			buf.WriteString(arg.String())
+		}
+		return buf.String()
+	}
+	RunTestFromString(t, input, handler, AllowTrailingComma(), QuotedArgs())
+
+	// Without the option, the trailing comma produces an empty value.
+	RunTestFromString(t, `
+vals a=(x, y,)
+----
+a=(x, y, "")
+`, handler)
+}
+
 func TestSkip(t *testing.T) {
 	RunTestFromString(t, `
 skip
@@ -120,6 +410,24 @@ func TestSubTest(t *testing.T) {
 	})
 }
 
+func TestSanitizeSubTestName(t *testing.T) {
+	for _, tc := range []struct {
+		name, expected string
+	}{
+		{"foo", "foo"},
+		{"foo/bar-baz_1.2", "foo/bar-baz_1.2"},
+		{"foo bar", "foo_bar"},
+		{"foo(bar)", "foo_bar_"},
+		{"a|b/c*", "a_b/c_"},
+		{"tab\there", "tab_here"},
+	} {
+		sanitized, ok := sanitizeSubTestName(tc.name)
+		if sanitized != tc.expected || ok != (tc.name == tc.expected) {
+			t.Errorf("%q: expected %q, got %q (%t)", tc.name, tc.expected, sanitized, ok)
+		}
+	}
+}
+
 func TestMultiLineTest(t *testing.T) {
 	RunTest(t, "testdata/multiline", func(t *testing.T, d *TestData) string {
 		switch d.Cmd {
@@ -148,6 +456,19 @@ func TestDirective(t *testing.T) {
 			fmt.Fprintf(&buf, "key=%#v vals=%#v\n", a.Key, a.Vals)
 		}
 		return buf.String()
+	}, QuotedArgs())
+}
+
+func TestRunTestE(t *testing.T) {
+	RunTestE(t, "testdata/error", func(t *testing.T, d *TestData) (string, error) {
+		switch d.Cmd {
+		case "ok":
+			return d.Input, nil
+		case "fail":
+			return "ignored", errors.New(d.Input)
+		default:
+			return "", fmt.Errorf("unknown directive: %s", d.Cmd)
+		}
 	})
 }
 
@@ -159,6 +480,29 @@ func TestWalk(t *testing.T) {
 	})
 }
 
+func TestWalkWithState(t *testing.T) {
+	var exited []string
+	WalkWithState(t, "testdata/walkstate",
+		func(t *testing.T, dir string, parent interface{}) interface{} {
+			if parent == nil {
+				return dir
+			}
+			return fmt.Sprintf("%s > %s", parent, dir)
+		},
+		func(t *testing.T, dir string, state interface{}) {
+			exited = append(exited, dir)
+		},
+		func(t *testing.T, path string, state interface{}) {
+			RunTest(t, path, func(t *testing.T, d *TestData) string {
+				return state.(string)
+			})
+		})
+	exp := []string{"testdata/walkstate/sub", "testdata/walkstate"}
+	if !reflect.DeepEqual(exited, exp) {
+		t.Fatalf("expected directories %v to be exited, got %v", exp, exited)
+	}
+}
+
 func TestRewrite(t *testing.T) {
 	const testDir = "testdata/rewrite"
 	files, err := ioutil.ReadDir(testDir)
@@ -199,6 +543,15 @@ func TestRewrite(t *testing.T) {
 				case "no-output":
 					return ""
 
+				case "contains":
+					return "never written"
+
+				case "echo":
+					return d.Input
+
+				case "hr":
+					return strings.ReplaceAll(d.Input, "hr", "----")
+
 				default:
 					t.Fatalf("unknown directive %s", d.Cmd)
 					return ""
@@ -207,6 +560,17 @@ func TestRewrite(t *testing.T) {
 
 			rewriteData := runTestInternal(t, path, file, handler, true /* rewrite */)
 
+			// Streaming the rewritten contents must produce the same result.
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			var streamed bytes.Buffer
+			runTestInternal(t, path, file, handler, true, /* rewrite */
+				func(o *options) { o.rewriteOut = &streamed })
+			if streamed.String() != string(rewriteData) {
+				t.Errorf("streamed rewrite %q differs from buffered rewrite %q", streamed.String(), rewriteData)
+			}
+
 			afterPath := filepath.Join(testDir, fmt.Sprintf("%s-after", test))
 			if *rewriteTestFiles {
 				// We are rewriting the rewrite tests. Dump the output into -after files
@@ -246,113 +610,2798 @@ func TestRewrite(t *testing.T) {
 	}
 }
 
-func TestMaybeScan_Noop(t *testing.T) {
+func TestOnlyDirective(t *testing.T) {
+	defer func(old int) { *onlyDirective = old }(*onlyDirective)
+	*onlyDirective = 2
+
+	var ran []string
 	RunTestFromString(t, `
-cmd
+fail
+----
+
+subtest foo
+
+run
+----
+ok
+
+subtest end
+
+fail
 ----
-"", "", ""
 `, func(t *testing.T, d *TestData) string {
-		var x, y, z string
-		d.MaybeScanArgs(t, "vals", &x, &y, &z)
-		return fmt.Sprintf("%q, %q, %q", x, y, z)
+		ran = append(ran, d.Cmd)
+		if d.Cmd == "fail" {
+			t.Fatalf("directive should have been skipped")
+		}
+		return "ok"
 	})
+	if !reflect.DeepEqual(ran, []string{"run"}) {
+		t.Fatalf("expected only the second directive to run, got %v", ran)
+	}
 }
 
-func TestScanArgsExpansion(t *testing.T) {
+func TestColorizeDiff(t *testing.T) {
+	const diff = "@@ -1,2 +1,2 @@\n a\n-b\n+c\n"
+	const exp = "@@ -1,2 +1,2 @@\n a\n\x1b[31m-b\x1b[0m\n\x1b[32m+c\x1b[0m\n"
+	if colorized := colorizeDiff(diff); colorized != exp {
+		t.Errorf("expected %q, got %q", exp, colorized)
+	}
+	if uncolorized := uncolorizeDiff(exp); uncolorized != diff {
+		t.Errorf("expected %q, got %q", diff, uncolorized)
+	}
+
+	t.Setenv("NO_COLOR", "1")
+	if useColor() {
+		t.Errorf("expected NO_COLOR to disable colors")
+	}
+}
+
+func TestContains(t *testing.T) {
 	RunTestFromString(t, `
-cmd vals=(foo, bar, bax)
+print contains
 ----
-"foo", "bar", "bax"
+line 2
+line 3
+
+print not-contains
+----
+line 4
 `, func(t *testing.T, d *TestData) string {
-		var x, y, z string
-		d.ScanArgs(t, "vals", &x, &y, &z)
-		return fmt.Sprintf("%q, %q, %q", x, y, z)
+		return "line 1\nline 2\nline 3\n"
 	})
+
+	// Verify that mismatches are detected.
+	r := newTestDataReader(
+		t, "<string>", strings.NewReader("print contains\n----\nline 4\n"), false, options{},
+	)
+	r.Next(t)
+	if failure := r.checkExpected(&r.data, "line 1\n"); !strings.Contains(failure, "missing from") {
+		t.Fatalf("expected failure, got %q", failure)
+	}
 }
 
-func TestScanArgsSingle(t *testing.T) {
-	checkScanEquivalence := func(d *TestData, dest1, dest2 interface{}) {
-		d.ScanArgs(t, "vals", dest1)
-		if _, ok := d.Arg("vals"); !ok {
-			t.Fatal("`vals` argument not found by TestData.Arg")
-		}
-		if ok := d.MaybeScanArgs(t, "vals", dest2); !ok {
-			t.Fatal("`vals` argument not found by TestData.MaybeScanArgs")
+func TestMultiset(t *testing.T) {
+	RunTestFromString(t, `
+print multiset
+----
+b
+a
+b
+`, func(t *testing.T, d *TestData) string {
+		return "a\nb\nb\n"
+	})
+
+	// Verify that differing counts are detected.
+	r := newTestDataReader(
+		t, "<string>", strings.NewReader("print multiset\n----\na\nb\nb\n"), false, options{},
+	)
+	r.Next(t)
+	failure := r.checkExpected(&r.data, "b\na\nc\n")
+	for _, exp := range []string{`"b": expected 2, found 1`, `"c": expected 0, found 1`} {
+		if !strings.Contains(failure, exp) {
+			t.Errorf("expected failure to contain %q, got %q", exp, failure)
 		}
-		if !reflect.DeepEqual(dest1, dest2) {
-			t.Fatalf("scanned values %#v and %#v are unequal", dest1, dest2)
+	}
+}
+
+// logTB is a testing.TB which records the messages it logs.
+type logTB struct {
+	testing.TB
+	logs []string
+}
+
+func (*logTB) Helper() {}
+
+func (tb *logTB) Logf(format string, args ...interface{}) {
+	tb.logs = append(tb.logs, fmt.Sprintf(format, args...))
+}
+
+func TestLogSummary(t *testing.T) {
+	defer func(old bool) { *quietLog = old }(*quietLog)
+	*quietLog = false
+	if !testing.Verbose() {
+		if err := flag.Set("test.v", "true"); err != nil {
+			t.Fatal(err)
 		}
+		defer func() { _ = flag.Set("test.v", "false") }()
+	}
+
+	summary := func(only int) string {
+		defer func(old int) { *onlyDirective = old }(*onlyDirective)
+		*onlyDirective = only
+		var tb *logTB
+		// The summary is logged once the subtest has finished.
+		t.Run("run", func(t *testing.T) {
+			tb = &logTB{TB: t}
+			RunTestFromStringAny(tb, "echo\na\n----\na\n\necho\nb\n----\nb\n",
+				func(t testing.TB, d *TestData) string {
+					return d.Input
+				})
+		})
+		return tb.logs[len(tb.logs)-1]
+	}
+	if s := summary(0); !strings.HasPrefix(s, "<string>: 2 directives, 2 passed in ") {
+		t.Errorf("unexpected summary: %q", s)
+	}
+	// Directives skipped with -datadriven-directive are not counted.
+	if s := summary(2); !strings.HasPrefix(s, "<string>: 1 directives, 1 passed in ") {
+		t.Errorf("unexpected summary: %q", s)
 	}
+}
 
+func TestCollectOutputs(t *testing.T) {
+	outputs := make(map[string]string)
 	RunTestFromString(t, `
-[]string vals=(foo, bar, bax)
+echo
+a
 ----
-[]string{"foo", "bar", "bax"}
+a
 
-[]int vals=(1, 2, 3, 4)
+echo
+b
 ----
-[]int{1, 2, 3, 4}
+b
+`, func(t *testing.T, d *TestData) string {
+		return d.Input
+	}, CollectOutputs(outputs))
+	if exp := map[string]string{"<string>:2": "a\n", "<string>:7": "b\n"}; !reflect.DeepEqual(outputs, exp) {
+		t.Errorf("expected %v, got %v", exp, outputs)
+	}
+}
 
-[]uint64 vals=(1, 2, 3, 4)
+func TestIgnorePlaceholder(t *testing.T) {
+	random := func(t *testing.T, d *TestData) string {
+		return fmt.Sprintf("%d\n", time.Now().UnixNano())
+	}
+	RunTestFromString(t, `
+random
 ----
-[]uint64{0x1, 0x2, 0x3, 0x4}
+[ignore]
+`, random)
+	RunTestFromString(t, `
+random
+----
+  ???
+`, random, IgnorePlaceholder("???"))
 
-string vals=(foo)
+	// With an empty placeholder, the results are always checked.
+	r := newTestDataReader(
+		t, "<string>", strings.NewReader("random\n----\n[ignore]\n"), false,
+		makeOptions([]Option{IgnorePlaceholder("")}),
+	)
+	r.Next(t)
+	if failure := r.checkExpected(&r.data, "1\n"); failure == "" {
+		t.Fatal("expected failure")
+	}
+}
+
+// panicReporter is a Reporter that panics with the reported error.
+type panicReporter struct{}
+
+func (panicReporter) Helper() {}
+
+func (panicReporter) Fatalf(format string, args ...interface{}) {
+	panic(fmt.Sprintf(format, args...))
+}
+
+func TestParseTestData(t *testing.T) {
+	directives, err := ParseTestData("<string>", strings.NewReader(`
+build a=1
+foo
 ----
-"foo"
+bar
 
-bool vals=true
+subtest sub
+check
 ----
-true
+----
+x
 
-float64 vals=1.1
+y
+----
 ----
-1.1
 
-[]float64 vals=(1.1, 2.2, 3.3, 4.4)
+subtest end
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	for _, d := range directives {
+		fmt.Fprintf(&buf, "%s %s %q %q %q\n", d.Pos, d.Cmd, d.CmdArgs, d.Input, d.Expected)
+	}
+	const exp = `<string>:2 build ["a=1"] "foo" "bar\n"
+<string>:7 subtest ["sub"] "" ""
+<string>:8 check [] "" "x\n\ny\n"
+<string>:17 subtest ["end"] "" ""
+`
+	if buf.String() != exp {
+		t.Errorf("expected:\n%s\nfound:\n%s", exp, buf.String())
+	}
+
+	_, err = ParseTestData("<string>", strings.NewReader("build a=(1\n"))
+	if exp := "<string>:1: cannot parse directive at column 9: build a=(1"; fmt.Sprint(err) != exp {
+		t.Errorf("expected error %q, got %v", exp, err)
+	}
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected a *ParseError, got %T", err)
+	}
+	expErr := ParseError{
+		Pos: "<string>:1", Kind: ErrDirective, Msg: "cannot parse directive at column 9: build a=(1",
+	}
+	if *pe != expErr {
+		t.Errorf("expected %+v, got %+v", expErr, *pe)
+	}
+}
+
+func TestCountDirectives(t *testing.T) {
+	n, err := CountDirectives("<string>", strings.NewReader(`
+a
 ----
-[]float64{1.1, 2.2, 3.3, 4.4}
 
-time.Duration vals=10.0m
+subtest sub
+b
 ----
-10m0s
-	`, func(t *testing.T, d *TestData) string {
-		switch d.Cmd {
-		case "[]string":
-			var dest1, dest2 []string
-			checkScanEquivalence(d, &dest1, &dest2)
-			return fmt.Sprintf("%#v", dest1)
-		case "[]int":
-			var dest1, dest2 []int
-			checkScanEquivalence(d, &dest1, &dest2)
-			return fmt.Sprintf("%#v", dest1)
-		case "[]uint64":
-			var dest1, dest2 []uint64
-			checkScanEquivalence(d, &dest1, &dest2)
-			return fmt.Sprintf("%#v", dest1)
-		case "[]float64":
-			var dest1, dest2 []float64
-			checkScanEquivalence(d, &dest1, &dest2)
-			return fmt.Sprintf("%#v", dest1)
-		case "float64":
-			var dest1, dest2 float64
-			checkScanEquivalence(d, &dest1, &dest2)
-			return fmt.Sprintf("%#v", dest1)
-		case "time.Duration":
-			var dest1, dest2 time.Duration
-			checkScanEquivalence(d, &dest1, &dest2)
-			return fmt.Sprintf("%s", dest1)
-		case "string":
-			var dest1, dest2 string
-			checkScanEquivalence(d, &dest1, &dest2)
+x
+
+# comment
+c
+----
+y
+subtest end
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 directives, got %d", n)
+	}
+
+	if _, err := CountDirectives("<string>", strings.NewReader("cmd a=(\n")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDoubleSeparatorEnd(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		opts  []Option
+		err   string
+		kind  ParseErrorKind
+	}{
+		{input: "cmd\n----\n----\nfoo\n----\n----\n# comment\ncmd\n----\nbar\n"},
+		{
+			input: "cmd\n----\n----\nfoo\n----\n----\nstray\n\ncmd\n----\nbar\n",
+			err:   "<string>:7: non-blank line after end of double ---- separator section: stray",
+			kind:  ErrTrailingLine,
+		},
+		{
+			input: "cmd\n----\n----\nfoo\n----\n\ncmd\n----\nbar\n",
+			opts:  []Option{StrictBlockEnd()},
+			err:   "<string>:1: EOF encountered before the end of the double ---- separator section",
+			kind:  ErrUnterminatedBlock,
+		},
+	} {
+		directives, err := ParseTestData("<string>", strings.NewReader(tc.input), tc.opts...)
+		if tc.err != "" {
+			if fmt.Sprint(err) != tc.err {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+			var pe *ParseError
+			if !errors.As(err, &pe) || pe.Kind != tc.kind {
+				t.Errorf("expected a *ParseError of kind %s, got %#v", tc.kind, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(directives) != 2 || directives[1].Pos != "<string>:8" {
+			t.Errorf("unexpected directives: %+v", directives)
+		}
+	}
+
+	// Without StrictBlockEnd, an unterminated section extends to the end of
+	// the file.
+	directives, err := ParseTestData("<string>", strings.NewReader("cmd\n----\n----\nfoo\n\nbar\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(directives) != 1 || directives[0].Expected != "foo\n\nbar\n" {
+		t.Errorf("unexpected directives: %+v", directives)
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	check := func(input string, opts ...Option) (failure string) {
+		defer func() {
+			if r := recover(); r != nil {
+				failure = r.(string)
+			}
+		}()
+		CheckFile(panicReporter{}, "<string>", strings.NewReader(input), func(d *TestData) string {
+			return strings.ToUpper(d.Input)
+		}, opts...)
+		return ""
+	}
+
+	const valid = "upper\nfoo\n----\nFOO\n\nsubtest bar\n\nupper\n----\n\nsubtest end\n"
+	if failure := check(valid); failure != "" {
+		t.Fatalf("unexpected failure: %s", failure)
+	}
+	if failure := check("upper\nfoo\n----\nfoo\n"); !strings.Contains(failure, "<string>:1") {
+		t.Fatalf("expected mismatch, got %q", failure)
+	}
+	if failure := check("upper a=(\n----\n"); !strings.Contains(failure, "cannot parse directive") {
+		t.Fatalf("expected parse error, got %q", failure)
+	}
+
+	// Directives without expected results are not checked.
+	if failure := check("upper\nfoo\n\nupper\nbar\n----\nBAR\n", OptionalSeparator()); failure != "" {
+		t.Fatalf("unexpected failure: %s", failure)
+	}
+
+	// Only the active conditional expected block is checked.
+	const conditional = "upper\nfoo\n---- if=linux\nFOO\n\n---- if=darwin\nfoo\n"
+	if failure := check(conditional, ActiveKeys("linux")); failure != "" {
+		t.Fatalf("unexpected failure: %s", failure)
+	}
+	if failure := check(conditional, ActiveKeys("darwin")); !strings.Contains(failure, "<string>:1") {
+		t.Fatalf("expected mismatch, got %q", failure)
+	}
+	const exp = "<string>:1: none of the conditional expected blocks applies to the active keys"
+	if failure := check(conditional); failure != exp {
+		t.Fatalf("expected failure %q, got %q", exp, failure)
+	}
+}
+
+func TestFormatPos(t *testing.T) {
+	RunTestFromString(t, `
+pos
+----
+virtual/<string>#L2
+
+pos
+----
+virtual/<string>#L6
+`, func(t *testing.T, d *TestData) string {
+		return d.Pos
+	}, FormatPos(func(file string, line int) string {
+		return fmt.Sprintf("virtual/%s#L%d", file, line)
+	}))
+}
+
+func TestBackRefs(t *testing.T) {
+	RunTestFromString(t, `
+echo label=foo
+a
+b
+----
+a
+b
+
+echo
+c
+----
+c
+
+echo
+x
+a
+b
+y
+----
+x
+@same-as(foo)
+y
+`, func(t *testing.T, d *TestData) string {
+		return d.Input
+	})
+}
+
+func TestRedactions(t *testing.T) {
+	opt := Redactions(map[string][]Redaction{
+		"insert": {{Re: regexp.MustCompile(`id=\d+`), Repl: "id=<redacted>"}},
+	})
+	handler := func(t *testing.T, d *TestData) string {
+		return fmt.Sprintf("id=%d\n", rand.Int())
+	}
+	RunTestFromString(t, `
+insert
+----
+id=<redacted>
+
+insert
+----
+id=12
+`, handler, opt)
+
+	// Other commands are not redacted.
+	r := newTestDataReader(t, "<string>", strings.NewReader("select\n----\nid=1\n"), false,
+		makeOptions([]Option{opt}))
+	r.Next(t)
+	if failure := r.checkExpected(&r.data, "id=2\n"); failure == "" {
+		t.Fatal("expected failure")
+	}
+
+	rewritten := runTestInternal(t, "<string>", strings.NewReader("insert\n----\n"),
+		func(t testing.TB, d *TestData) string { return handler(t.(*testing.T), d) },
+		true /* rewrite */, opt)
+	if exp := "insert\n----\nid=<redacted>\n"; string(rewritten) != exp {
+		t.Errorf("expected %q, got %q", exp, rewritten)
+	}
+}
+
+func TestActiveKeys(t *testing.T) {
+	const input = `
+os
+----
+default
+
+---- if=linux
+----
+linux
+
+output
+----
+----
+
+---- if=darwin
+darwin
+
+next
+----
+ok
+`
+	for _, key := range []string{"", "linux", "darwin"} {
+		RunTestFromString(t, input, func(t *testing.T, d *TestData) string {
+			switch {
+			case d.Cmd == "next":
+				return "ok"
+			case key == "":
+				return "default"
+			case key == "linux":
+				return "linux\n\noutput"
+			default:
+				return key
+			}
+		}, ActiveKeys(key))
+	}
+
+	// Only the active block is rewritten.
+	rewritten := runTestInternal(t, "<string>", strings.NewReader(input),
+		func(t testing.TB, d *TestData) string {
+			if d.Cmd == "next" {
+				return "ok"
+			}
+			return "new"
+		}, true /* rewrite */, ActiveKeys("darwin"))
+	if exp := strings.Replace(input, "\ndarwin\n", "\nnew\n", 1); string(rewritten) != exp {
+		t.Errorf("expected:\n%s\nfound:\n%s", exp, rewritten)
+	}
+
+	defer func() {
+		const exp = "<string>:2: none of the conditional expected blocks applies to the active keys"
+		if r := recover(); r != exp {
+			t.Fatalf("expected failure %q, got %v", exp, r)
+		}
+	}()
+	RunTestFromStringAny(fatalTB{t}, "\nos\n---- if=linux\nlinux\n", func(t testing.TB, d *TestData) string {
+		return "linux"
+	})
+}
+
+func TestScrubGoRuntime(t *testing.T) {
+	const in = "panic: boom\n\t/src/foo/bar.go:123 +0x1f\nptr=0xc000012345 x.go.txt:4\n"
+	const exp = "panic: boom\n\t/src/foo/bar.go:<line> +0x<addr>\nptr=0x<addr> x.go.txt:4\n"
+	if out := ScrubGoRuntime(in); out != exp {
+		t.Errorf("expected %q, got %q", exp, out)
+	}
+}
+
+func TestRecall(t *testing.T) {
+	RunTestFromString(t, `
+build store=base
+a
+----
+a
+
+extend
+b
+----
+a+b
+
+extend from=missing
+c
+----
+<none>
+`, func(t *testing.T, d *TestData) string {
+		if d.Cmd == "build" {
+			return d.Input
+		}
+		from := "base"
+		d.MaybeScanArgs(t, "from", &from)
+		base, ok := d.Recall(from)
+		if !ok {
+			return "<none>"
+		}
+		return strings.TrimSpace(base) + "+" + d.Input
+	})
+}
+
+func TestIgnoreLinePrefixes(t *testing.T) {
+	opt := IgnoreLinePrefixes("generated at ", "#")
+	handler := func(t testing.TB, d *TestData) string {
+		return fmt.Sprintf("generated at %s\n# comment\nresult", time.Now())
+	}
+	RunTestFromStringAny(t, `
+gen
+----
+generated at yesterday
+result
+`, handler, opt)
+
+	rewritten := runTestInternal(t, "<string>", strings.NewReader("gen\n----\n"), handler,
+		true /* rewrite */, opt)
+	if exp := "gen\n----\nresult\n"; string(rewritten) != exp {
+		t.Errorf("expected %q, got %q", exp, rewritten)
+	}
+}
+
+func TestInlineComments(t *testing.T) {
+	opt := InlineComments("// note:")
+	handler := func(t testing.TB, d *TestData) string {
+		return d.Input
+	}
+	RunTestFromStringAny(t, `
+echo
+a
+b
+----
+// note: a comes first
+a
+b
+// note: trailing
+`, handler, opt)
+
+	input := "echo\na\nc\nd\n----\n// note: a comes first\na\n// note: then b\nb\n// note: trailing\n"
+	rewritten := runTestInternal(t, "<string>", strings.NewReader(input), handler,
+		true /* rewrite */, opt)
+	exp := "echo\na\nc\nd\n----\n// note: a comes first\na\n// note: then b\nc\nd\n// note: trailing\n"
+	if string(rewritten) != exp {
+		t.Errorf("expected %q, got %q", exp, rewritten)
+	}
+}
+
+func TestAnnotateRewrite(t *testing.T) {
+	handler := func(t testing.TB, d *TestData) string {
+		return d.Input
+	}
+	input := "echo a=1\nfoo\n----\nbar\n\necho\n# output of: old\n----\n"
+	exp := "echo a=1\nfoo\n# output of: echo a=1\n----\nfoo\n\necho\n# output of: echo\n----\n"
+	rewritten := runTestInternal(t, "<string>", strings.NewReader(input), handler,
+		true /* rewrite */, AnnotateRewrite())
+	if string(rewritten) != exp {
+		t.Fatalf("expected %q, got %q", exp, rewritten)
+	}
+	// The annotations are not part of the input.
+	RunTestFromStringAny(t, exp, handler, AnnotateRewrite())
+	rewritten = runTestInternal(t, "<string>", strings.NewReader(exp), handler,
+		true /* rewrite */, AnnotateRewrite())
+	if string(rewritten) != exp {
+		t.Errorf("expected %q, got %q", exp, rewritten)
+	}
+
+	// Directives without input, with DefaultCmd.
+	exp = "# output of: echo\n----\n"
+	rewritten = runTestInternal(t, "<string>", strings.NewReader(exp), handler,
+		true /* rewrite */, AnnotateRewrite(), DefaultCmd("echo"))
+	if string(rewritten) != exp {
+		t.Errorf("expected %q, got %q", exp, rewritten)
+	}
+}
+
+func TestComparators(t *testing.T) {
+	caseInsensitive := func(expected, actual string) (bool, string) {
+		if strings.EqualFold(expected, actual) {
+			return true, ""
+		}
+		return false, fmt.Sprintf("%q is not %q", actual, expected)
+	}
+	opt := Comparators(map[string]Comparator{"fold": caseInsensitive})
+	RunTestFromString(t, `
+fold
+FOO
+----
+foo
+`, func(t *testing.T, d *TestData) string {
+		return d.Input
+	}, opt)
+
+	r := newTestDataReader(t, "<string>", strings.NewReader("fold\nbar\n----\nfoo\n"), false,
+		makeOptions([]Option{opt}))
+	r.Next(t)
+	failure := r.checkExpected(&r.data, "bar\n")
+	if !strings.Contains(failure, `"bar\n" is not "foo\n"`) {
+		t.Fatalf("unexpected failure: %q", failure)
+	}
+}
+
+func TestPreprocessFile(t *testing.T) {
+	tmpl := func(name, contents string) (string, error) {
+		tpl, err := template.New(name).Parse(contents)
+		if err != nil {
+			return "", err
+		}
+		var buf strings.Builder
+		if err := tpl.Execute(&buf, map[string]int{"N": 3}); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	RunTestFromString(t, `
+repeat n={{.N}}
+x
+----
+xxx
+`, func(t *testing.T, d *TestData) string {
+		var n int
+		d.ScanArgs(t, "n", &n)
+		return strings.Repeat(d.Input, n)
+	}, PreprocessFile(tmpl))
+
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "<string>: template:") {
+			t.Fatalf("expected template error, got %v", r)
+		}
+	}()
+	RunTestFromStringAny(fatalTB{t}, "cmd {{\n----\n", func(t testing.TB, d *TestData) string {
+		return ""
+	}, PreprocessFile(tmpl))
+}
+
+func TestEchoInput(t *testing.T) {
+	RunTestFromString(t, `
+format echo-input
+a  +   b
+----
+a + b
+ok
+
+format
+a  +   b
+----
+ok
+
+format echo-input
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+		d.Input = strings.Join(strings.Fields(d.Input), " ")
+		return "ok"
+	})
+}
+
+func TestTable(t *testing.T) {
+	RunTestFromString(t, `
+query table
+----
+id | name
+---+------
+1  | foo
+2  | bar
+
+query-plain table
+----
+id  name
+1   foo
+2   bar
+
+query-markdown table
+----
+| id | name |
+| -- | ---- |
+| 1  | foo  |
+| 2  | bar  |
+`, func(t *testing.T, d *TestData) string {
+		if d.Cmd == "query-plain" {
+			return "id name\n1 foo\n2 bar"
+		}
+		return "| id | name |\n| 1 | foo |\n| 2 | bar |"
+	})
+
+	// Rows of "-" cells, as used for NULL values, are not borders.
+	for _, tc := range []struct {
+		output string
+		rows   [][]string
+	}{
+		{"a | b\n- | -\n1 | 2\n- | -\n", [][]string{{"a", "b"}, {"-", "-"}, {"1", "2"}, {"-", "-"}}},
+		{"+---+---+\n| a | b |\n+---+---+\n| - | - |\n+---+---+\n", [][]string{{"a", "b"}, {"-", "-"}}},
+		{"a  b\n-  -\n1  -\n", [][]string{{"a", "b"}, {"-", "-"}, {"1", "-"}}},
+		{"a   b\n--  ---\n-   -\n", [][]string{{"a", "b"}, {"-", "-"}}},
+	} {
+		if rows, _ := parseTable(tc.output); !reflect.DeepEqual(rows, tc.rows) {
+			t.Errorf("%q: expected rows %q, got %q", tc.output, tc.rows, rows)
+		}
+		if rows, _ := parseTable(renderTable(tc.output)); !reflect.DeepEqual(rows, tc.rows) {
+			t.Errorf("%q: expected rendered rows %q, got %q", tc.output, tc.rows, rows)
+		}
+	}
+
+	r := newTestDataReader(t, "<string>",
+		strings.NewReader("query table\n----\na | b\n1 | 2\n"), false, options{})
+	r.Next(t)
+	failure := r.checkExpected(&r.data, "a | b\n1 | 3\n")
+	if exp := `<string>:1: row 2, column 2: expected "2", found "3"`; !strings.HasPrefix(failure, exp) {
+		t.Errorf("expected failure starting with %q, got %q", exp, failure)
+	}
+}
+
+func TestTolerance(t *testing.T) {
+	RunTestFromString(t, `
+compute tolerance=1e-6
+----
+pi = 3.1415926
+e  = 2.7182818
+`, func(t *testing.T, d *TestData) string {
+		return fmt.Sprintf("pi = %v\ne = %v", math.Pi, math.E)
+	})
+
+	for _, tc := range []struct {
+		expected, actual string
+		fail             bool
+	}{
+		{"pi = 3.1415926", "pi = 3.15", true},
+		{"pi = 3.1415926", "tau = 3.1415926", true},
+		{"pi = 3.1415926", "pi = 3.1415926 2", true},
+		{"x = NaN", "x = 1.0", true},
+		{"x = 1.0", "x = NaN", true},
+		{"x = +Inf", "x = 1e300", true},
+		{"x = 1e300", "x = -Inf", true},
+		{"x = +Inf", "x = -Inf", true},
+		{"x = NaN", "x = nan", false},
+		{"x = +Inf", "x = inf", false},
+	} {
+		r := newTestDataReader(t, "<string>",
+			strings.NewReader("compute tolerance=1e-6\n----\n"+tc.expected+"\n"), false, options{})
+		r.Next(t)
+		if failure := r.checkExpected(&r.data, tc.actual+"\n"); (failure != "") != tc.fail {
+			t.Errorf("expected %q vs %q to fail: %t, got %q", tc.expected, tc.actual, tc.fail, failure)
+		}
+	}
+}
+
+func TestKnownFail(t *testing.T) {
+	const input = `
+add knownfail
+1 + 1
+----
+2
+`
+	RunTestFromString(t, input, func(t *testing.T, d *TestData) string {
+		return "3"
+	})
+
+	defer func() {
+		const exp = "<string>:2: directive marked knownfail produced the expected output; " +
+			"remove the knownfail argument"
+		if r := recover(); r != exp {
+			t.Fatalf("expected failure %q, got %v", exp, r)
+		}
+	}()
+	RunTestFromStringAny(fatalTB{t}, input, func(t testing.TB, d *TestData) string {
+		return "2"
+	})
+}
+
+func TestMaxDuration(t *testing.T) {
+	handler := func(t testing.TB, d *TestData) string {
+		var sleep time.Duration
+		d.ScanArgs(t, "sleep", &sleep)
+		time.Sleep(sleep)
+		return "ok"
+	}
+	RunTestFromStringAny(t, `
+sleep sleep=0s max-duration=1m
+----
+ok
+`, handler)
+
+	// Only the invocation whose allocations are counted is timed, not the
+	// warm-up invocation.
+	calls := 0
+	RunTestFromStringAny(t, `
+warm-up max-duration=40ms assert-allocs=1000
+----
+ok
+`, func(t testing.TB, d *TestData) string {
+		if calls++; calls == 1 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return "ok"
+	})
+
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "more than max-duration=1ms") {
+			t.Fatalf("expected failure, got %v", r)
+		}
+	}()
+	RunTestFromStringAny(fatalTB{t}, `
+sleep sleep=10ms max-duration=1ms
+----
+ok
+`, handler)
+}
+
+func TestSilent(t *testing.T) {
+	var state []string
+	handler := func(t testing.TB, d *TestData) string {
+		switch d.Cmd {
+		case "add":
+			state = append(state, d.Input)
+			return ""
+		default:
+			return strings.Join(state, ",")
+		}
+	}
+	RunTestFromStringAny(t, `
+add silent
+a
+
+add silent
+b
+----
+
+list
+----
+a,b
+`, handler)
+
+	defer func() {
+		const exp = "<string>:2: expected no output from silent directive, found:\na,b\n"
+		if r := recover(); r != exp {
+			t.Fatalf("expected failure %q, got %v", exp, r)
+		}
+	}()
+	RunTestFromStringAny(fatalTB{t}, "\nlist silent\n", handler)
+}
+
+func TestHash(t *testing.T) {
+	RunTestFromString(t, `
+print hash=sha256
+----
+73cb3858a687a8494ca3323053016282f3dad39d42cf62ca4e79dda2aac7d9ac
+`, func(t *testing.T, d *TestData) string {
+		return "x"
+	})
+
+	// Other values are left to the handler.
+	RunTestFromString(t, `
+print hash=md4
+----
+md4
+`, func(t *testing.T, d *TestData) string {
+		var algo string
+		d.ScanArgs(t, "hash", &algo)
+		return algo
+	})
+}
+
+func TestParallelDirectives(t *testing.T) {
+	// Parallel directives run after the directives in subtests, but before
+	// RunTest returns.
+	var mu sync.Mutex
+	var order []string
+	RunTestFromString(t, `
+run name=b
+----
+ok
+
+run name=a
+----
+ok
+
+subtest sequential
+run name=sequential
+----
+ok
+
+subtest end
+`, func(t *testing.T, d *TestData) string {
+		var name string
+		d.ScanArgs(t, "name", &name)
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, name)
+		return "ok"
+	}, ParallelDirectives())
+
+	if len(order) != 3 {
+		t.Fatalf("expected all directives to have run, got %q", order)
+	}
+	sort.Strings(order[1:])
+	if exp := "sequential a b"; strings.Join(order, " ") != exp {
+		t.Errorf("expected directives to run in order %q, got %q", exp, order)
+	}
+}
+
+func TestPreprocessInput(t *testing.T) {
+	const input = `
+greet
+$name
+----
+hello, world
+`
+	expand := PreprocessInput(func(cmd, input string) string {
+		return strings.ReplaceAll(input, "$name", "world")
+	})
+	greet := func(t testing.TB, d *TestData) string {
+		return "hello, " + d.Input
+	}
+	RunTestFromStringAny(t, input, greet, expand)
+
+	// The test file keeps the original input when rewriting.
+	rewritten := runTestInternal(t, "<string>", strings.NewReader(input), greet, true, expand)
+	if string(rewritten) != input {
+		t.Fatalf("unexpected rewrite:\n%s", rewritten)
+	}
+}
+
+func TestDefaultCmd(t *testing.T) {
+	const input = `
+1 + 2
+----
+eval [1 + 2]
+
+{"a": 1}
+----
+eval [{"a": 1}]
+
+----
+eval []
+
+echo
+1 + 2
+----
+echo [1 + 2]
+`
+	eval := func(t testing.TB, d *TestData) string {
+		return fmt.Sprintf("%s [%s]", d.Cmd, d.Input)
+	}
+	RunTestFromStringAny(t, input, eval, DefaultCmd("eval"))
+
+	rewritten := runTestInternal(t, "<string>", strings.NewReader(input), eval, true,
+		DefaultCmd("eval"))
+	if string(rewritten) != input {
+		t.Fatalf("unexpected rewrite:\n%s", rewritten)
+	}
+
+	// Extra blank lines don't start directives, and lines with several
+	// commands are directives.
+	directives, err := ParseTestData("<string>", strings.NewReader(
+		"eval\n1\n----\neval [1]\n\n\necho,print x=1\nx\n----\nx\n"), DefaultCmd("eval"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmds []string
+	for _, d := range directives {
+		cmds = append(cmds, fmt.Sprintf("%s %q", d.Cmd, d.Input))
+	}
+	if exp := []string{`eval "1"`, `echo,print "x"`}; !reflect.DeepEqual(cmds, exp) {
+		t.Errorf("expected %q, got %q", exp, cmds)
+	}
+}
+
+func TestOptionalSeparator(t *testing.T) {
+	const input = `
+set a=1
+
+set b=2
+ignored output
+
+get
+----
+a=1 b=2
+
+set c=3`
+	vals := map[string]string{}
+	handler := func(t testing.TB, d *TestData) string {
+		switch d.Cmd {
+		case "set":
+			vals[d.CmdArgs[0].Key] = d.CmdArgs[0].Vals[0]
+			return "ignored output"
+		case "get":
+			return fmt.Sprintf("a=%s b=%s", vals["a"], vals["b"])
+		}
+		return ""
+	}
+	RunTestFromStringAny(t, input, handler, OptionalSeparator())
+	if vals["c"] != "3" {
+		t.Fatalf("expected the last directive to run")
+	}
+
+	rewritten := runTestInternal(t, "<string>", strings.NewReader(input), handler, true,
+		OptionalSeparator())
+	if string(rewritten) != input+"\n" {
+		t.Fatalf("unexpected rewrite:\n%s", rewritten)
+	}
+}
+
+// allocSink makes allocations escape to the heap.
+var allocSink []byte
+
+func TestAssertAllocs(t *testing.T) {
+	var lazy []byte
+	handler := func(t testing.TB, d *TestData) string {
+		if d.Cmd == "lazy" {
+			// One-time initializations are not counted.
+			if lazy == nil {
+				lazy = make([]byte, 64)
+			}
+			return "ok"
+		}
+		// Avoid ScanArgs, which allocates.
+		n, _ := strconv.Atoi(d.CmdArgs[0].Vals[0])
+		for i := 0; i < n; i++ {
+			allocSink = make([]byte, 64)
+		}
+		return "ok"
+	}
+	RunTestFromStringAny(t, `
+alloc n=0 assert-allocs=0
+----
+ok
+
+lazy assert-allocs=0
+----
+ok
+
+alloc n=3 assert-allocs=3
+----
+ok
+`, handler)
+
+	defer func() {
+		const exp = "<string>:1: handler made 4 allocations, more than assert-allocs=3"
+		if r := recover(); r != exp {
+			t.Errorf("expected failure %q, got %v", exp, r)
+		}
+	}()
+	RunTestFromStringAny(fatalTB{t}, "alloc n=4 assert-allocs=3\n----\nok\n", handler)
+}
+
+func TestPeek(t *testing.T) {
+	RunTestFromString(t, `
+begin
+----
+next: insert
+
+# Comments and blank lines are skipped.
+
+insert
+----
+----
+next: subtest
+
+(blank line above)
+----
+----
+# A comment right after the block.
+subtest sub
+commit
+----
+next: subtest
+
+subtest end
+
+last
+----
+next: <none>
+`, func(t *testing.T, d *TestData) string {
+		cmd, ok := d.Peek()
+		if !ok {
+			cmd = "<none>"
+		}
+		if d.Cmd == "insert" {
+			return "next: " + cmd + "\n\n(blank line above)"
+		}
+		return "next: " + cmd
+	})
+}
+
+func TestExpectSameAs(t *testing.T) {
+	const input = `
+naive label=naive
+1 2 3
+----
+6
+
+optimized expect-same-as=naive
+1 2 3
+----
+`
+	sum := func(t testing.TB, d *TestData) string {
+		res := 0
+		for _, f := range strings.Fields(d.Input) {
+			n, _ := strconv.Atoi(f)
+			res += n
+		}
+		return fmt.Sprint(res)
+	}
+	RunTestFromStringAny(t, input, sum)
+
+	rewritten := runTestInternal(t, "<string>", strings.NewReader(input), sum, true)
+	if string(rewritten) != input {
+		t.Fatalf("unexpected rewrite:\n%s", rewritten)
+	}
+
+	r := newTestDataReader(t, "<string>",
+		strings.NewReader("optimized expect-same-as=naive\n1 2 3\n----\n"), false, options{})
+	r.Next(t)
+	r.outputs = map[string]string{"naive": "6\n"}
+	failure := r.checkExpected(&r.data, "7\n")
+	if !strings.Contains(failure, "output differs from that of the directive with label=naive") {
+		t.Errorf("unexpected failure: %q", failure)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	RunTestFromString(t, `
+count retry
+----
+3
+`, func(t *testing.T, d *TestData) string {
+		calls++
+		return fmt.Sprint(calls)
+	})
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+
+	// Verify that the last output is reported once the timeout elapses.
+	r := newTestDataReader(
+		t, "<string>", strings.NewReader("count retry timeout=20ms\n----\nnever\n"), false, options{},
+	)
+	r.Next(t)
+	calls = 0
+	actual := retryHandler(t, r, &r.data, func(t testing.TB, d *TestData) string {
+		calls++
+		return fmt.Sprint(calls)
+	}, "0\n")
+	if calls < 2 || actual != fmt.Sprintf("%d\n", calls) {
+		t.Fatalf("unexpected output %q after %d calls", actual, calls)
+	}
+}
+
+func TestUserData(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	RunTestFromString(t, `
+rand
+----
+ok
+`, func(t *testing.T, d *TestData) string {
+		if d.UserData != rng {
+			t.Fatalf("unexpected user data %v", d.UserData)
+		}
+		return "ok"
+	}, UserData(rng))
+}
+
+func TestCheckTestFiles(t *testing.T) {
+	defer func(old bool) { *checkTestFiles = old }(*checkTestFiles)
+	*checkTestFiles = true
+
+	handler := func(t testing.TB, d *TestData) string {
+		return d.Input
+	}
+	// The expected results are ignored, as when rewriting.
+	RunTestFromStringAny(t, "echo\nfoo\n----\nfoo\n", handler)
+
+	msg := func() (msg string) {
+		defer func() { msg, _ = recover().(string) }()
+		RunTestFromStringAny(fatalTB{t}, "echo\nfoo\n----\nbar\n", handler)
+		return ""
+	}()
+	if !strings.Contains(msg, "test file is not up to date") || !strings.Contains(msg, "-bar\n+foo\n") {
+		t.Errorf("unexpected failure: %q", msg)
+	}
+
+	// Directives with the retry meta-argument are retried until they match.
+	calls := 0
+	RunTestFromStringAny(t, "poll retry\n----\nready\n", func(t testing.TB, d *TestData) string {
+		if calls++; calls < 3 {
+			return "pending"
+		}
+		return "ready"
+	})
+
+	defer func(old int) { *onlyDirective = old }(*onlyDirective)
+	*onlyDirective = 1
+	msg = func() (msg string) {
+		defer func() { msg, _ = recover().(string) }()
+		RunTestFromStringAny(fatalTB{t}, "echo\nfoo\n----\nfoo\n", handler)
+		return ""
+	}()
+	if msg != "-datadriven-directive cannot be combined with -datadriven-check" {
+		t.Errorf("unexpected failure: %q", msg)
+	}
+}
+
+func TestRewriteSubTest(t *testing.T) {
+	defer func(old bool) { *rewriteTestFiles = old }(*rewriteTestFiles)
+	defer func(old string) { *rewriteSubTest = old }(*rewriteSubTest)
+	*rewriteTestFiles = true
+	*rewriteSubTest = "a"
+
+	input := `echo
+x
+----
+stale
+
+subtest a
+echo
+y
+----
+stale
+
+subtest a/nested
+echo
+z
+----
+stale
+
+subtest end
+
+subtest end
+
+subtest b
+echo
+w
+----
+stale
+
+subtest end
+`
+	exp := strings.Replace(strings.Replace(input, "y\n----\nstale", "y\n----\ny", 1),
+		"z\n----\nstale", "z\n----\nz", 1)
+	rewritten := runTestInternal(t, "<string>", strings.NewReader(input),
+		func(t testing.TB, d *TestData) string {
+			return d.Input
+		}, true /* rewrite */)
+	if string(rewritten) != exp {
+		t.Errorf("expected:\n%s\ngot:\n%s", exp, rewritten)
+	}
+}
+
+func TestRewriteUnchangedFile(t *testing.T) {
+	defer func(old bool) { *rewriteTestFiles = old }(*rewriteTestFiles)
+	*rewriteTestFiles = true
+
+	dir := t.TempDir()
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	unchanged := write("unchanged", "echo\nfoo\n----\nfoo\n")
+	changed := write("changed", "echo\nfoo\n----\nbar\n")
+
+	for _, path := range []string{unchanged, changed} {
+		RunTest(t, path, func(t *testing.T, d *TestData) string {
+			return d.Input
+		})
+	}
+
+	for path, expChanged := range map[string]bool{unchanged: false, changed: true} {
+		finfo, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mtimeChanged := !finfo.ModTime().Equal(past); mtimeChanged != expChanged {
+			t.Errorf("%s: expected mtime change: %t, got: %t", path, expChanged, mtimeChanged)
+		}
+	}
+}
+
+func TestRewriteReplacesFile(t *testing.T) {
+	defer func(old bool) { *rewriteTestFiles = old }(*rewriteTestFiles)
+	*rewriteTestFiles = true
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test")
+	if err := ioutil.WriteFile(path, []byte("echo\nfoo\n----\nbar\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	RunTest(t, path, func(t *testing.T, d *TestData) string {
+		return d.Input
+	})
+
+	if b, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "echo\nfoo\n----\nfoo\n" {
+		t.Errorf("unexpected rewritten file:\n%s", b)
+	}
+	if finfo, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if perm := finfo.Mode().Perm(); perm != 0600 {
+		t.Errorf("expected permissions to be preserved, got %v", perm)
+	}
+	// No temporary files may be left behind.
+	if files, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 1 {
+		t.Errorf("expected a single file, found %d", len(files))
+	}
+}
+
+func TestRewriteSymlink(t *testing.T) {
+	defer func(old bool) { *rewriteTestFiles = old }(*rewriteTestFiles)
+	*rewriteTestFiles = true
+
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := ioutil.WriteFile(target, []byte("echo\nfoo\n----\nbar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+	RunTest(t, link, func(t *testing.T, d *TestData) string {
+		if d.File != link || d.Pos != link+":1" {
+			t.Errorf("expected the directive to be in %s, got %s (%s)", link, d.File, d.Pos)
+		}
+		return d.Input
+	})
+
+	if b, err := ioutil.ReadFile(target); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "echo\nfoo\n----\nfoo\n" {
+		t.Errorf("unexpected rewritten file:\n%s", b)
+	}
+	if finfo, err := os.Lstat(link); err != nil {
+		t.Fatal(err)
+	} else if finfo.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected %s to remain a symlink", link)
+	}
+}
+
+// nopCloser is a bytes.Buffer with a Close method.
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestRewriteSink(t *testing.T) {
+	defer func(old bool) { *rewriteTestFiles = old }(*rewriteTestFiles)
+	*rewriteTestFiles = true
+
+	path := filepath.Join(t.TempDir(), "test")
+	const contents = "echo\nfoo\n----\nbar\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	RunTest(t, path, func(t *testing.T, d *TestData) string {
+		return d.Input
+	}, RewriteSink(func(p string) io.WriteCloser {
+		if p != path {
+			t.Errorf("expected path %s, got %s", path, p)
+		}
+		return nopCloser{&buf}
+	}))
+
+	if exp := "echo\nfoo\n----\nfoo\n"; buf.String() != exp {
+		t.Errorf("expected %q to be written to the sink, got %q", exp, buf.String())
+	}
+	// The test file itself must be left untouched.
+	if b, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if string(b) != contents {
+		t.Errorf("unexpected rewritten file:\n%s", b)
+	}
+}
+
+func TestWriteDoc(t *testing.T) {
+	defer func(old string) { *docDir = old }(*docDir)
+	*docDir = filepath.Join(t.TempDir(), "doc")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(wd) }()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join("testdata", "example.txt")
+	if err := os.Mkdir("testdata", 0755); err != nil {
+		t.Fatal(err)
+	}
+	const input = `eval a=1 b=(2, 3)
+1 + 2
+----
+3
+
+subtest sub
+eval
+----
+----
+x
+
+y
+----
+----
+
+subtest end
+`
+	if err := ioutil.WriteFile(path, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fail := func(t *testing.T, d *TestData) string {
+		t.Fatalf("directives must not run")
+		return ""
+	}
+
+	read := func() string {
+		b, err := ioutil.ReadFile(filepath.Join(*docDir, "testdata", "example.md"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	RunTest(t, path, fail)
+	const exp = "```\neval a=1 b=(2, 3)\n1 + 2\n----\n3\n```\n\n```\neval\n----\nx\n\ny\n```\n"
+	if doc := read(); doc != exp {
+		t.Errorf("expected:\n%s\nfound:\n%s", exp, doc)
+	}
+
+	RunTest(t, path, fail, RenderDoc(func(d *TestData) string {
+		return fmt.Sprintf("- %s: %s", d.Cmd, strings.TrimSpace(d.Expected))
+	}))
+	const expCustom = "- eval: 3\n\n- eval: x\n\ny\n"
+	if doc := read(); doc != expCustom {
+		t.Errorf("expected:\n%s\nfound:\n%s", expCustom, doc)
+	}
+
+	// Test files with the same name in different directories don't collide.
+	for _, dir := range []string{"a", "b"} {
+		if err := os.MkdirAll(filepath.Join("walk", dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		contents := fmt.Sprintf("eval\n----\n%s\n", dir)
+		if err := ioutil.WriteFile(filepath.Join("walk", dir, "foo"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Walk(t, "walk", func(t *testing.T, path string) {
+		RunTest(t, path, fail)
+	})
+	for _, dir := range []string{"a", "b"} {
+		b, err := ioutil.ReadFile(filepath.Join(*docDir, "walk", dir, "foo.md"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := fmt.Sprintf("```\neval\n----\n%s\n```\n", dir); string(b) != exp {
+			t.Errorf("expected:\n%s\nfound:\n%s", exp, b)
+		}
+	}
+}
+
+func TestJSONResults(t *testing.T) {
+	var buf bytes.Buffer
+	RunTestFromString(t, `
+echo
+foo
+----
+foo
+
+subtest bar
+
+noop
+----
+
+subtest end
+`, func(t *testing.T, d *TestData) string {
+		return d.Input
+	}, JSONResults(&buf))
+
+	const expected = `{"pos":"<string>:2","cmd":"echo","passed":true}
+{"pos":"<string>:9","cmd":"noop","passed":true}
+`
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\nfound:\n%s", expected, buf.String())
+	}
+
+	// Verify that failures are reported with a diff.
+	var res Result
+	r := newTestDataReader(t, "<string>", strings.NewReader("echo\nfoo\n----\nbar\n"), false,
+		makeOptions([]Option{ResultSink(func(r Result) { res = r })}))
+	r.Next(t)
+	failure := r.checkExpected(&r.data, "foo\n")
+	r.reportResult(Result{Pos: r.data.Pos, Cmd: r.data.Cmd, Diff: failure})
+	if res.Passed || !strings.Contains(res.Diff, "expected:\nbar\n") {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestResultSinkFailures(t *testing.T) {
+	for _, tc := range []struct {
+		input   string
+		opts    []Option
+		failure string
+	}{
+		{input: "cmd max-duration=1ns\n----\nok\n", failure: "<string>:1: handler took"},
+		{input: "cmd assert-allocs=0\n----\nok\n", failure: "<string>:1: handler made"},
+		{input: "cmd\n----\nok\tok\n", opts: []Option{RejectTabs()}, failure: "<string>:1: line 1 of the expected"},
+		{input: "cmd\n---- if=linux\nok\n", failure: "<string>:1: none of the conditional"},
+		{input: "cmd silent\n----\n", failure: "<string>:1: expected no output"},
+		{input: "fatal\n----\nok\n", failure: "boom"},
+	} {
+		var results []Result
+		func() {
+			defer func() {
+				if r := recover(); r == nil || !strings.HasPrefix(r.(string), tc.failure) {
+					t.Errorf("%q: expected failure %q, got %v", tc.input, tc.failure, r)
+				}
+			}()
+			opts := append(tc.opts, ResultSink(func(res Result) { results = append(results, res) }))
+			RunTestFromStringAny(fatalTB{t}, tc.input, func(t testing.TB, d *TestData) string {
+				if d.Cmd == "fatal" {
+					t.Fatalf("boom")
+				}
+				time.Sleep(time.Millisecond)
+				allocSink = make([]byte, 64)
+				return "ok"
+			}, opts...)
+		}()
+		if exp := []Result{{Pos: "<string>:1", Cmd: strings.Fields(tc.input)[0]}}; !reflect.DeepEqual(results, exp) {
+			t.Errorf("%q: expected results %+v, got %+v", tc.input, exp, results)
+		}
+	}
+}
+
+func TestRewriteField(t *testing.T) {
+	for _, rewrite := range []bool{false, true} {
+		runTestInternal(t, "<string>", strings.NewReader("rewrite\n----\n"),
+			func(t testing.TB, d *TestData) string {
+				if d.Rewrite != rewrite {
+					t.Fatalf("expected Rewrite=%t", rewrite)
+				}
+				return ""
+			}, rewrite)
+	}
+}
+
+func TestMaybeScan_Noop(t *testing.T) {
+	RunTestFromString(t, `
+cmd
+----
+"", "", ""
+`, func(t *testing.T, d *TestData) string {
+		var x, y, z string
+		d.MaybeScanArgs(t, "vals", &x, &y, &z)
+		return fmt.Sprintf("%q, %q, %q", x, y, z)
+	})
+}
+
+func TestScanArgsExpansion(t *testing.T) {
+	RunTestFromString(t, `
+cmd vals=(foo, bar, bax)
+----
+"foo", "bar", "bax"
+`, func(t *testing.T, d *TestData) string {
+		var x, y, z string
+		d.ScanArgs(t, "vals", &x, &y, &z)
+		return fmt.Sprintf("%q, %q, %q", x, y, z)
+	})
+}
+
+func TestScanArgsSingle(t *testing.T) {
+	checkScanEquivalence := func(d *TestData, dest1, dest2 interface{}) {
+		d.ScanArgs(t, "vals", dest1)
+		if _, ok := d.Arg("vals"); !ok {
+			t.Fatal("`vals` argument not found by TestData.Arg")
+		}
+		if ok := d.MaybeScanArgs(t, "vals", dest2); !ok {
+			t.Fatal("`vals` argument not found by TestData.MaybeScanArgs")
+		}
+		if !reflect.DeepEqual(dest1, dest2) {
+			t.Fatalf("scanned values %#v and %#v are unequal", dest1, dest2)
+		}
+	}
+
+	RunTestFromString(t, `
+[]string vals=(foo, bar, bax)
+----
+[]string{"foo", "bar", "bax"}
+
+[]int vals=(1, 2, 3, 4)
+----
+[]int{1, 2, 3, 4}
+
+[]uint64 vals=(1, 2, 3, 4)
+----
+[]uint64{0x1, 0x2, 0x3, 0x4}
+
+string vals=(foo)
+----
+"foo"
+
+bool vals=true
+----
+true
+
+float64 vals=1.1
+----
+1.1
+
+[]float64 vals=(1.1, 2.2, 3.3, 4.4)
+----
+[]float64{1.1, 2.2, 3.3, 4.4}
+
+time.Duration vals=10.0m
+----
+10m0s
+
+[]time.Duration vals=(1s, 2s, 500ms)
+----
+[]time.Duration{1000000000, 2000000000, 500000000}
+
+*big.Int vals=123456789012345678901234567890
+----
+123456789012345678901234567890
+
+*big.Int vals=0xffffffffffffffffffff
+----
+1208925819614629174706175
+
+*url.URL vals=http://localhost:8080/foo?bar=baz
+----
+http://localhost:8080/foo?bar=baz
+	`, func(t *testing.T, d *TestData) string {
+		switch d.Cmd {
+		case "[]string":
+			var dest1, dest2 []string
+			checkScanEquivalence(d, &dest1, &dest2)
+			return fmt.Sprintf("%#v", dest1)
+		case "[]int":
+			var dest1, dest2 []int
+			checkScanEquivalence(d, &dest1, &dest2)
+			return fmt.Sprintf("%#v", dest1)
+		case "[]uint64":
+			var dest1, dest2 []uint64
+			checkScanEquivalence(d, &dest1, &dest2)
+			return fmt.Sprintf("%#v", dest1)
+		case "[]float64":
+			var dest1, dest2 []float64
+			checkScanEquivalence(d, &dest1, &dest2)
+			return fmt.Sprintf("%#v", dest1)
+		case "float64":
+			var dest1, dest2 float64
+			checkScanEquivalence(d, &dest1, &dest2)
+			return fmt.Sprintf("%#v", dest1)
+		case "[]time.Duration":
+			var dest1, dest2 []time.Duration
+			checkScanEquivalence(d, &dest1, &dest2)
+			return fmt.Sprintf("%#v", dest1)
+		case "time.Duration":
+			var dest1, dest2 time.Duration
+			checkScanEquivalence(d, &dest1, &dest2)
+			return fmt.Sprintf("%s", dest1)
+		case "*big.Int":
+			var dest1, dest2 big.Int
+			checkScanEquivalence(d, &dest1, &dest2)
+			return dest1.String()
+		case "*url.URL":
+			var dest1, dest2 url.URL
+			checkScanEquivalence(d, &dest1, &dest2)
+			return dest1.String()
+		case "string":
+			var dest1, dest2 string
+			checkScanEquivalence(d, &dest1, &dest2)
 			return fmt.Sprintf("%#v", dest1)
 		case "bool":
 			var dest1, dest2 bool
 			checkScanEquivalence(d, &dest1, &dest2)
 			return fmt.Sprintf("%#v", dest1)
 		default:
-			return fmt.Sprintf("unrecognized type %s", d.Cmd)
+			return fmt.Sprintf("unrecognized type %s", d.Cmd)
+		}
+	})
+}
+
+func TestScanArgsOptional(t *testing.T) {
+	RunTestFromString(t, `
+scan limit=10 name=foo
+----
+limit=10 name=foo
+
+scan name=foo
+----
+limit=<nil> name=foo
+
+scan
+----
+limit=<nil> name=<nil>
+`, func(t *testing.T, d *TestData) string {
+		var limit *int
+		var name *string
+		d.ScanArgs(t, "limit", &limit)
+		d.ScanArgs(t, "name", &name)
+		var buf strings.Builder
+		buf.WriteString("limit=")
+		if limit != nil {
+			fmt.Fprint(&buf, *limit)
+		} else {
+			buf.WriteString("<nil>")
+		}
+		buf.WriteString(" name=")
+		if name != nil {
+			buf.WriteString(*name)
+		} else {
+			buf.WriteString("<nil>")
+		}
+		return buf.String()
+	})
+}
+
+func TestRegisterValueScanner(t *testing.T) {
+	type point struct{ X, Y int }
+	RegisterValueScanner("point:", func(val string, dest interface{}) error {
+		p, ok := dest.(*point)
+		if !ok {
+			return fmt.Errorf("cannot scan a point into %T", dest)
+		}
+		_, err := fmt.Sscanf(val, "%d,%d", &p.X, &p.Y)
+		return err
+	})
+	RunTestFromString(t, `
+scan p=point:1,2
+----
+{X:1 Y:2}
+
+scan p=point:1
+----
+error: unexpected EOF
+
+scan p=1,2
+----
+error: unsupported type *datadriven.point for destination #1 (might be easy to add it)
+`, func(t *testing.T, d *TestData) string {
+		var p point
+		arg, _ := d.Arg("p")
+		if err := arg.scanAllErr(&p); err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return fmt.Sprintf("%+v", p)
+	})
+}
+
+// levelFlag is a flag.Value used to test scanning into such values.
+type levelFlag int
+
+func (l *levelFlag) String() string { return fmt.Sprint(int(*l)) }
+
+func (l *levelFlag) Set(s string) error {
+	switch s {
+	case "low":
+		*l = 1
+	case "high":
+		*l = 2
+	default:
+		return fmt.Errorf("invalid level %q", s)
+	}
+	return nil
+}
+
+func TestScanFlagValue(t *testing.T) {
+	RunTestFromString(t, `
+scan level=high
+----
+2
+
+scan level=bogus
+----
+error: invalid level "bogus"
+`, func(t *testing.T, d *TestData) string {
+		var l levelFlag
+		arg, _ := d.Arg("level")
+		if err := arg.scanAllErr(&l); err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return l.String()
+	})
+}
+
+// fatalTB is a testing.TB whose Fatalf panics with the reported error, so that
+// tests can check for expected failures.
+type fatalTB struct {
+	testing.TB
+}
+
+func (fatalTB) Helper() {}
+
+func (fatalTB) Fatalf(format string, args ...interface{}) {
+	panic(fmt.Sprintf(format, args...))
+}
+
+func (fatalTB) Fatal(args ...interface{}) {
+	panic(fmt.Sprint(args...))
+}
+
+// Run runs subtests inline, so that their failures also panic.
+func (tb fatalTB) Run(name string, f func(testing.TB)) {
+	f(tb)
+}
+
+func TestSubTestDiagnostics(t *testing.T) {
+	RunTestFromString(t, `
+run
+subtest a
+subtest a/b
+subtest end a/b
+subtest a/c
+subtest end
+subtest end
+----
+ok
+
+run
+subtest a
+subtest a/b
+subtest a/c
+subtest end a/c
+subtest end a
+----
+<string>:3: subtest "a/c" cannot be nested in subtest "a/b", whose nested subtests must begin with "a/b/"; is a subtest end directive missing?
+<string>:2: subtest "a/b" started here
+
+run
+subtest a
+subtest a/b
+subtest end a
+----
+<string>:3: mismatched subtest end directive: expected "a/b", got "a"
+<string>:2: subtest "a/b" started here
+
+run
+subtest a
+subtest a/b
+subtest end a/b
+----
+<string>:3: EOF encountered without subtest end directive for "a"
+<string>:1: subtest started here
+
+run
+subtest end a
+----
+<string>:1: subtest end without corresponding start
+`, func(t *testing.T, d *TestData) (res string) {
+		defer func() {
+			if r := recover(); r != nil {
+				res = r.(string)
+			}
+		}()
+		runTestInternal(fatalTB{t}, "<string>", strings.NewReader(d.Input),
+			func(t testing.TB, d *TestData) string { return "" }, false /* rewrite */)
+		return "ok"
+	})
+}
+
+func TestRewriteHint(t *testing.T) {
+	const hint = "run with -rewrite"
+	fail := func(input string, opts ...Option) (failure string) {
+		defer func() {
+			failure = recover().(string)
+		}()
+		runTestInternal(fatalTB{t}, "<string>", strings.NewReader(input),
+			func(t testing.TB, d *TestData) string { return d.Input }, false /* rewrite */, opts...)
+		return ""
+	}
+	const input = "echo\nfoo\n----\nbar\n"
+	if failure := fail(input); !strings.Contains(failure, hint) {
+		t.Errorf("expected hint in failure:\n%s", failure)
+	}
+	if failure := fail(input, NoRewriteHint()); strings.Contains(failure, hint) {
+		t.Errorf("unexpected hint in failure:\n%s", failure)
+	}
+	// Rewriting preserves the expected results of these directives.
+	for _, input := range []string{
+		"echo contains\nfoo\n----\nbar\n",
+		"echo not-contains\nfoo\n----\nfoo\n",
+		"echo label=a\nfoo\n----\nfoo\n\necho expect-same-as=a\nbar\n----\n",
+	} {
+		if failure := fail(input); strings.Contains(failure, hint) {
+			t.Errorf("unexpected hint in failure:\n%s", failure)
+		}
+	}
+}
+
+func TestExpandEnvArgs(t *testing.T) {
+	t.Setenv("DATADRIVEN_DIR", "/tmp/data")
+	const input = `
+args path=$DATADRIVEN_DIR/file vals=(${DATADRIVEN_DIR}, $DATADRIVEN_UNSET!) literal=$$
+----
+path=/tmp/data/file vals=(/tmp/data, !) literal=$
+`
+	args := func(t testing.TB, d *TestData) string {
+		var buf strings.Builder
+		for i, arg := range d.CmdArgs {
+			if i > 0 {
+				buf.WriteString(" ")
+			}
+			buf.WriteString(arg.String())
+		}
+		return buf.String()
+	}
+	RunTestFromStringAny(t, input, args, ExpandEnvArgs(false /* strict */))
+
+	defer func() {
+		const exp = `<string>:2: vals: environment variable "DATADRIVEN_UNSET" is not set`
+		if r := recover(); r != exp {
+			t.Fatalf("expected failure %q, got %v", exp, r)
+		}
+	}()
+	RunTestFromStringAny(fatalTB{t}, input, args, ExpandEnvArgs(true /* strict */))
+}
+
+func TestTabContinuation(t *testing.T) {
+	const input = "build\n\ta=1\n\tb=(2, 3)\nfoo\n----\n[a=1 b=(2, 3)] foo\n"
+	handler := func(t *testing.T, d *TestData) string {
+		return fmt.Sprintf("%s %s", d.CmdArgs, d.Input)
+	}
+	RunTestFromString(t, input, handler, TabContinuation())
+
+	rewritten := runTestInternal(t, "<string>", strings.NewReader(input),
+		func(t testing.TB, d *TestData) string { return handler(t.(*testing.T), d) },
+		true /* rewrite */, TabContinuation())
+	if string(rewritten) != input {
+		t.Errorf("expected the file to be unchanged, got %q", rewritten)
+	}
+}
+
+func TestArgRefs(t *testing.T) {
+	args := func(t testing.TB, d *TestData) string {
+		var buf strings.Builder
+		for i, arg := range d.CmdArgs {
+			if i > 0 {
+				buf.WriteString(" ")
+			}
+			buf.WriteString(arg.String())
+		}
+		return buf.String()
+	}
+	RunTestFromStringAny(t, `
+args a=foo b=@a c=(@a, bar)
+----
+a=foo b=foo c=(foo, bar)
+`, args, ArgRefs())
+
+	// Without the option, references are taken literally.
+	RunTestFromStringAny(t, `
+args a=foo b=@a
+----
+a=foo b=@a
+`, args)
+
+	for input, exp := range map[string]string{
+		"args b=@a\n----\n":          `<string>:1: b: no argument "a" to refer to`,
+		"args a=(1, 2) b=@a\n----\n": `<string>:1: b: argument "a" must have a single value to be referred to`,
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r != exp {
+					t.Errorf("expected failure %q, got %v", exp, r)
+				}
+			}()
+			RunTestFromStringAny(fatalTB{t}, input, args, ArgRefs())
+		}()
+	}
+}
+
+func TestFile(t *testing.T) {
+	const path = "testdata/directive"
+	RunTest(t, path, func(t *testing.T, d *TestData) string {
+		if d.File != path {
+			t.Errorf("expected file %s, got %s", path, d.File)
+		}
+		return d.Expected
+	}, FormatPos(func(file string, line int) string { return "elsewhere" }), QuotedArgs())
+}
+
+func TestFileArgs(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "fixture.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test")
+	const contents = `
+cat input-file=fixture.txt
+----
+hello
+
+cat
+----
+<none>
+`
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	RunTest(t, path, func(t *testing.T, d *TestData) string {
+		if data, ok := d.ArgFile("input-file"); ok {
+			return string(data)
+		}
+		return "<none>"
+	}, FileArgs("input-file"))
+
+	_, err := ParseTestData(path, strings.NewReader("cat input-file=missing.txt\n----\n"),
+		FileArgs("input-file"))
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Kind != ErrArgument || pe.Pos != path+":1" {
+		t.Errorf("expected an argument error, got %v", err)
+	}
+}
+
+func TestSortArgs(t *testing.T) {
+	RunTestFromString(t, `
+args c=(2, 1) a=x b a=y
+----
+[a=x a=y b c=(2, 1)]
+`, func(t *testing.T, d *TestData) string {
+		return fmt.Sprint(d.CmdArgs)
+	}, SortArgs())
+}
+
+func TestRejectTabs(t *testing.T) {
+	for _, tc := range []struct {
+		input, output string
+		expected      string
+	}{
+		{
+			input:    "cmd\n----\na\nb\tc\n",
+			output:   "a\nb c",
+			expected: `<string>:1: line 2 of the expected results contains a tab; please use spaces: "b\tc"`,
+		},
+		{
+			input:    "cmd\n----\na b\n",
+			output:   "a\tb",
+			expected: `<string>:1: line 1 of the actual results contains a tab; please use spaces: "a\tb"`,
+		},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r != tc.expected {
+					t.Errorf("expected failure %q, got %v", tc.expected, r)
+				}
+			}()
+			RunTestFromStringAny(fatalTB{t}, tc.input, func(t testing.TB, d *TestData) string {
+				return tc.output
+			}, RejectTabs())
+		}()
+	}
+
+	// Rewriting replaces expected results containing tabs.
+	rewritten := runTestInternal(t, "<string>", strings.NewReader("cmd\n----\na\tb\n"),
+		func(t testing.TB, d *TestData) string { return "a b" },
+		true /* rewrite */, RejectTabs())
+	if exp := "cmd\n----\na b\n"; string(rewritten) != exp {
+		t.Errorf("expected %q, got %q", exp, rewritten)
+	}
+}
+
+func TestSubTestHooks(t *testing.T) {
+	var events []string
+	hooks := []Option{
+		OnSubTestStart(func(name string) { events = append(events, "start "+name) }),
+		OnSubTestEnd(func(name string) { events = append(events, "end "+name) }),
+	}
+	func() {
+		// The failure of the second directive ends the subtests early.
+		defer func() { _ = recover() }()
+		RunTestFromStringAny(fatalTB{t}, `
+subtest a
+subtest a/b
+echo
+----
+
+fail
+----
+
+subtest end
+subtest end
+`, func(t testing.TB, d *TestData) string {
+			if d.Cmd == "fail" {
+				t.Fatalf("failed")
+			}
+			return ""
+		}, hooks...)
+	}()
+
+	const exp = "start a, start a/b, end a/b, end a"
+	if got := strings.Join(events, ", "); got != exp {
+		t.Errorf("expected %q, got %q", exp, got)
+	}
+}
+
+func TestWalkIsLeaf(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"case-1/input", "case-1/output", "other/plain"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var leaves []string
+	Walk(t, dir, func(t *testing.T, path string) {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, filepath.ToSlash(rel))
+	}, IsLeaf(func(path string, info os.FileInfo) bool {
+		return strings.HasPrefix(info.Name(), "case-")
+	}))
+	if exp := "case-1 other/plain"; strings.Join(leaves, " ") != exp {
+		t.Errorf("expected leaves %q, got %q", exp, leaves)
+	}
+}
+
+func TestWalkGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a/one", "a/two", "b/one", "three"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		flag, option string
+		expected     string
+	}{
+		{option: "a/*", expected: "a/one a/two"},
+		{flag: "*/one", expected: "a/one b/one"},
+		{flag: "*/one", option: "a/*", expected: "a/one"},
+		{option: "three", expected: "three"},
+	} {
+		t.Run(tc.flag+"_"+tc.option, func(t *testing.T) {
+			defer func(old string) { *walkGlob = old }(*walkGlob)
+			*walkGlob = tc.flag
+
+			var leaves []string
+			Walk(t, dir, func(t *testing.T, path string) {
+				rel, err := filepath.Rel(dir, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				leaves = append(leaves, filepath.ToSlash(rel))
+			}, Glob(tc.option))
+			if actual := strings.Join(leaves, " "); actual != tc.expected {
+				t.Errorf("expected leaves %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestWalkHandler(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"kv/put", "sql/select", "other"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var calls []string
+	handler := func(name string) func(t testing.TB, path string) {
+		return func(t testing.TB, path string) {
+			calls = append(calls, name+":"+filepath.Base(path))
+		}
+	}
+	under := func(sub string) func(path string) bool {
+		return func(path string) bool {
+			return strings.HasPrefix(path, filepath.Join(dir, sub)+string(filepath.Separator))
+		}
+	}
+	Walk(t, dir, func(t *testing.T, path string) {
+		calls = append(calls, "default:"+filepath.Base(path))
+	}, WalkHandler(under("kv"), handler("kv")), WalkHandler(under("sql"), handler("sql")))
+	if exp := "kv:put default:other sql:select"; strings.Join(calls, " ") != exp {
+		t.Errorf("expected calls %q, got %q", exp, calls)
+	}
+}
+
+func TestWalkSetup(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"_setup": "set x=1\n----\n",
+		"a/test": "get\n----\n1\n",
+		"b":      "set x=2\n----\n\nget\n----\n2\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var leaves []string
+	Walk(t, dir, func(t *testing.T, path string) {
+		leaves = append(leaves, filepath.Base(path))
+		var x string
+		RunTest(t, path, func(t *testing.T, d *TestData) string {
+			switch d.Cmd {
+			case "set":
+				d.ScanArgs(t, "x", &x)
+				return ""
+			default:
+				return x
+			}
+		}, Setup(filepath.Join(dir, "_setup")))
+	}, SetupFile("_setup"))
+	if exp := "test b"; strings.Join(leaves, " ") != exp {
+		t.Errorf("expected leaves %q, got %q", exp, leaves)
+	}
+
+	// A setup file in a subdirectory would not be run.
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", "_setup"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		exp := fmt.Sprintf("%s: setup file \"_setup\" is only supported at the root of the walk, %s",
+			filepath.Join(dir, "a"), dir)
+		if r := recover(); r != exp {
+			t.Errorf("expected failure %q, got %v", exp, r)
+		}
+	}()
+	WalkAny(fatalTB{t}, dir, func(t testing.TB, path string) {}, SetupFile("_setup"))
+}
+
+func TestWalkNameCollisions(t *testing.T) {
+	writeFiles := func(names ...string) string {
+		dir := t.TempDir()
+		for _, name := range names {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dir
+	}
+	for _, names := range [][]string{{"Foo", "foo"}, {"bar.TXT", "bar.txt"}} {
+		dir := writeFiles(names...)
+		func() {
+			defer func() {
+				exp := fmt.Sprintf("%s: files %q and %q differ only by case", dir, names[0], names[1])
+				if r := recover(); r == nil || !strings.HasPrefix(r.(string), exp) {
+					t.Errorf("expected failure %q, got %v", exp, r)
+				}
+			}()
+			WalkAny(fatalTB{t}, dir, func(t testing.TB, path string) {})
+		}()
+	}
+
+	// Names which differ by extension are distinct test files.
+	dir := writeFiles("baz", "baz.txt")
+	var leaves []string
+	WalkAny(t, dir, func(t testing.TB, path string) {
+		leaves = append(leaves, filepath.Base(path))
+	})
+	if exp := "baz baz.txt"; strings.Join(leaves, " ") != exp {
+		t.Errorf("expected leaves %q, got %q", exp, leaves)
+	}
+}
+
+func TestRequireInputFormat(t *testing.T) {
+	RunTestFromString(t, `
+require kind=utf8
+héllo
+----
+ok
+
+require kind=utf8
+bad \xff byte
+----
+<string>:7: input line 1 is not valid UTF-8: "bad \xff byte"
+
+require kind=json
+{"a": [1, 2]}
+----
+ok
+
+require kind=json
+{"a": [1, 2}
+----
+<string>:17: input is not valid JSON: invalid character '}' after array element
+
+require kind=xml
+<a/>
+----
+<string>:22: unsupported input format "xml"
+`, func(t *testing.T, d *TestData) (res string) {
+		var kind string
+		d.ScanArgs(t, "kind", &kind)
+		// Unescape the input so that the test file itself stays valid UTF-8.
+		if strings.Contains(d.Input, `\x`) {
+			input, err := strconv.Unquote(`"` + d.Input + `"`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.Input = input
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				res = r.(string)
+			}
+		}()
+		d.RequireInputFormat(fatalTB{t}, kind)
+		return "ok"
+	})
+}
+
+func TestScanRune(t *testing.T) {
+	RunTestFromString(t, `
+rune val=a
+----
+'a'
+
+rune val=7
+----
+<string>:6: val: "7" is ambiguous between a character and a code point; use '7' or U+0037 for the character
+
+rune val='7'
+----
+'7'
+
+rune val='\n'
+----
+'\n'
+
+rune val='ab'
+----
+<string>:18: val: 'ab' is not a valid quoted character
+
+rune val=U+0037
+----
+'7'
+
+rune val=é
+----
+'é'
+
+rune val=0x41
+----
+'A'
+
+rune val=U+00E9
+----
+'é'
+
+rune val=65
+----
+'A'
+
+rune val=ab
+----
+<string>:42: val: "ab" is neither a single character nor a numeric code point
+
+rune val=0x110000
+----
+<string>:46: val: "0x110000" is not a valid code point
+
+rune val=(a, b)
+----
+<string>:50: val: expected a single value, found 2
+`, func(t *testing.T, d *TestData) (res string) {
+		defer func() {
+			if r := recover(); r != nil {
+				res = r.(string)
+			}
+		}()
+		return fmt.Sprintf("%q", d.ScanRune(fatalTB{t}, "val"))
+	})
+}
+
+func TestScanInt32Byte(t *testing.T) {
+	RunTestFromString(t, `
+int32 val=7
+----
+7
+
+int32 val=-2147483648
+----
+-2147483648
+
+int32 val=2147483648
+----
+error: strconv.ParseInt: parsing "2147483648": value out of range
+
+byte val=255
+----
+0xff
+
+byte val=0x7f
+----
+0x7f
+
+byte val=256
+----
+error: strconv.ParseUint: parsing "256": value out of range
+`, func(t *testing.T, d *TestData) string {
+		arg, _ := d.Arg("val")
+		var i int32
+		var b byte
+		var dest interface{} = &i
+		if d.Cmd == "byte" {
+			dest = &b
+		}
+		if err := arg.scanAllErr(dest); err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		if d.Cmd == "byte" {
+			return fmt.Sprintf("%#x", b)
+		}
+		return fmt.Sprint(i)
+	})
+}
+
+func TestScanFlags(t *testing.T) {
+	type perm uint
+	names := map[string]perm{"READ": 1, "WRITE": 2, "EXEC": 4}
+	RunTestFromString(t, `
+scan flags=(READ, WRITE)
+----
+3
+
+scan flags=EXEC
+----
+4
+
+scan flags=(READ, DELETE)
+----
+flags: unknown flag "DELETE" (valid flags: EXEC, READ, WRITE)
+`, func(t *testing.T, d *TestData) (res string) {
+		arg, _ := d.Arg("flags")
+		defer func() {
+			if r := recover(); r != nil {
+				res = r.(string)
+			}
+		}()
+		return fmt.Sprint(ScanFlags(fatalTB{t}, arg, names))
+	})
+}
+
+func TestInputLinesAndRecords(t *testing.T) {
+	RunTestFromString(t, `
+split
+a
+b
+
+c
+----
+----
+lines: ["a" "b" "" "c"]
+records: ["a\nb" "c"]
+----
+----
+
+split
+----
+lines: []
+records: []
+`, func(t *testing.T, d *TestData) string {
+		return fmt.Sprintf("lines: %q\nrecords: %q", d.InputLines(), d.InputRecords("\n\n"))
+	})
+}
+
+// sliceSource is a DirectiveSource which supplies the directives of a slice.
+type sliceSource []TestData
+
+func (s *sliceSource) Next() (*TestData, bool) {
+	if len(*s) == 0 {
+		return nil, false
+	}
+	d := &(*s)[0]
+	*s = (*s)[1:]
+	return d, true
+}
+
+func TestRunTestFromSource(t *testing.T) {
+	source := sliceSource{
+		{Cmd: "echo", Input: "a", Expected: "a"},
+		{Cmd: "echo", Input: "b\nc", Expected: "c\nb\n", CmdArgs: []CmdArg{{Key: "multiset"}}},
+	}
+	var positions []string
+	RunTestFromSource(t, &source, func(t *testing.T, d *TestData) string {
+		positions = append(positions, d.Pos)
+		return d.Input
+	})
+	if exp := []string{"<source>:1", "<source>:2"}; !reflect.DeepEqual(positions, exp) {
+		t.Errorf("expected positions %v, got %v", exp, positions)
+	}
+}
+
+func TestLazyExpected(t *testing.T) {
+	const input = `
+echo
+a
+----
+a
+
+peek
+----
+next: subtest
+
+subtest sub
+echo
+b
+----
+b
+
+subtest end
+
+echo
+c
+----
+c
+`
+	var handled []string
+	RunTestFromString(t, input, func(t *testing.T, d *TestData) string {
+		if d.Expected != "" {
+			t.Fatalf("expected results read before the handler was invoked: %q", d.Expected)
+		}
+		handled = append(handled, d.Cmd)
+		switch d.Cmd {
+		case "peek":
+			// Peek skips the expected results, which are not read yet.
+			cmd, _ := d.Peek()
+			return "next: " + cmd
+		default:
+			return d.ExpectedString()
+		}
+	}, LazyExpected())
+	if exp := "echo peek echo echo"; strings.Join(handled, " ") != exp {
+		t.Errorf("expected directives %q, got %q", exp, handled)
+	}
+
+	// Expected results which are not needed are read past without being kept.
+	r := newTestDataReader(t, "<string>",
+		strings.NewReader("a\n----\n----\nx\n----\n----\n\nb\n----\ny\n"), false, options{})
+	r.lazyExpected = true
+	r.Next(t)
+	r.skipExpected()
+	if r.data.Expected != "" || r.data.rawExpected != nil {
+		t.Errorf("expected results kept: %q %q", r.data.Expected, r.data.rawExpected)
+	}
+	if !r.Next(t) || r.data.Cmd != "b" || r.data.ExpectedString() != "y\n" {
+		t.Errorf("unexpected next directive %q with expected results %q", r.data.Cmd, r.data.Expected)
+	}
+}
+
+func TestTail(t *testing.T) {
+	RunTestFromString(t, `
+echo tail=2
+a
+b
+c
+----
+b
+c
+
+echo tail=5
+a
+b
+----
+a
+b
+
+echo tail=0
+a
+----
+
+echo tail=end
+a
+b
+----
+a
+b
+`, func(t *testing.T, d *TestData) string {
+		return d.Input
+	})
+}
+
+func TestBreakpointIgnoredByDefault(t *testing.T) {
+	RunTestFromString(t, `
+echo breakpoint
+foo
+----
+foo
+`, func(t *testing.T, d *TestData) string {
+		return d.Input
+	})
+}
+
+func TestPosTransform(t *testing.T) {
+	defer func(old func(string) string) { PosTransform = old }(PosTransform)
+	PosTransform = func(pos string) string { return "repo/" + pos }
+
+	var pos string
+	msg := func() (msg string) {
+		defer func() { msg, _ = recover().(string) }()
+		input := "\necho\nfoo\n----\nbar\n"
+		RunTestFromStringAny(fatalTB{t}, input, func(t testing.TB, d *TestData) string {
+			pos = d.Pos
+			return d.Input
+		})
+		return ""
+	}()
+	if pos != "<string>:2" {
+		t.Errorf("expected TestData.Pos to be unaffected, got %q", pos)
+	}
+	if !strings.HasPrefix(msg, "\nrepo/<string>:2:\n") {
+		t.Errorf("unexpected failure: %q", msg)
+	}
+}
+
+func TestOneOf(t *testing.T) {
+	handler := func(t testing.TB, d *TestData) string {
+		return d.Input
+	}
+	RunTestFromStringAny(t, `
+echo one-of
+b
+a
+----
+a
+b
+---- or
+b
+a
+`, handler)
+
+	input := "echo one-of\nc\n----\na\n---- or\nb\n\necho one-of\nb\n----\na\n---- or\nb\n"
+	for _, tc := range []struct {
+		opts []Option
+		exp  string
+	}{
+		{nil, "echo one-of\nc\n----\nc\n\necho one-of\nb\n----\na\n---- or\nb\n"},
+		{
+			[]Option{AppendAlternatives()},
+			"echo one-of\nc\n----\na\n---- or\nb\n---- or\nc\n\necho one-of\nb\n----\na\n---- or\nb\n",
+		},
+	} {
+		rewritten := runTestInternal(t, "<string>", strings.NewReader(input), handler,
+			true /* rewrite */, tc.opts...)
+		if string(rewritten) != tc.exp {
+			t.Errorf("expected %q, got %q", tc.exp, rewritten)
+		}
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	RunTestFromString(t, `
+concat matrix-a=(1, 2) sep=- matrix-b=(x, y)
+----
+[a=1 b=x]
+1-x
+[a=1 b=y]
+1-y
+[a=2 b=x]
+2-x
+[a=2 b=y]
+2-y
+`, func(t *testing.T, d *TestData) string {
+		var a, b, sep string
+		d.ScanArgs(t, "a", &a)
+		d.ScanArgs(t, "b", &b)
+		d.ScanArgs(t, "sep", &sep)
+		return a + sep + b
+	})
+}
+
+func TestInputLinePos(t *testing.T) {
+	RunTestFromString(t, `
+validate
+
+a
+bad
+----
+<string>:5: invalid line "bad"
+
+validate \\
+  x=1
+ok
+bad
+----
+<string>:12: invalid line "bad"
+
+validate
+----
+<string>:16
+`, func(t *testing.T, d *TestData) string {
+		for i, line := range d.InputLines() {
+			if line == "bad" {
+				return fmt.Sprintf("%s: invalid line %q", d.InputLinePos(i+1), line)
+			}
+		}
+		return d.InputLinePos(1)
+	})
+}
+
+func TestScanStringer(t *testing.T) {
+	type color int
+	parseColor := func(s string) (color, error) {
+		for i, name := range []string{"red", "green", "blue"} {
+			if s == name {
+				return color(i), nil
+			}
 		}
+		return 0, fmt.Errorf("unknown color %q", s)
+	}
+	RunTestFromString(t, `
+scan c=(red, blue)
+----
+0 2
+
+scan c=purple
+----
+<string>:6: c: failed to scan argument 0: unknown color "purple"
+
+scan c=red
+----
+<string>:10: c: cannot scan value 1 of argument with 1 values
+`, func(t *testing.T, d *TestData) (res string) {
+		arg, _ := d.Arg("c")
+		defer func() {
+			if r := recover(); r != nil {
+				res = r.(string)
+			}
+		}()
+		first := ScanStringer(fatalTB{t}, d, arg, 0, parseColor)
+		second := ScanStringer(fatalTB{t}, d, arg, 1, parseColor)
+		return fmt.Sprint(first, " ", second)
 	})
 }
 
@@ -365,3 +3414,17 @@ unknown command
 		return "unknown command"
 	})
 }
+
+func FuzzParseForFuzz(f *testing.F) {
+	for _, seed := range []string{
+		"cmd a=1 b=(2, 3)\ninput\n----\noutput\n",
+		"cmd \\\n  x\n----\n----\na\n\nb\n----\n----\n",
+		"subtest a\ncmd\n----\nsubtest end\n",
+		"cmd \"a b\"=(\"x\", \n  y)\n----\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = ParseForFuzz(data)
+	})
+}
@@ -1,5 +1,8 @@
 module github.com/cockroachdb/datadriven
 
-go 1.17
+go 1.18
 
-require github.com/pmezard/go-difflib v1.0.0
+require (
+	github.com/pmezard/go-difflib v1.0.0
+	gopkg.in/yaml.v3 v3.0.1
+)
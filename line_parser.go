@@ -15,7 +15,10 @@
 package datadriven
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 )
@@ -35,7 +38,49 @@ import (
 //   cmd exprs=(a + (b + c), d + f)
 // is valid and produces the expected values for the argument.
 //
+// Double quotes have no special meaning; see ParseQuotedLine.
+//
 func ParseLine(line string) (cmd string, cmdArgs []CmdArg, err error) {
+	return parseLine(line, options{})
+}
+
+// ParseQuotedLine is like ParseLine, but parses argument names and values that
+// start with a double quote as Go string literals, as test files do with the
+// QuotedArgs option. This allows values to contain spaces, commas or
+// unbalanced parens:
+//   cmd sep=" " vals=("a, b", ")")
+//
+// Likewise, an argument name can be quoted to contain spaces or '=':
+//   cmd "a b"=1 "x=y"
+//
+// It parses the output of RenderDirective and CmdArg.String back into the same
+// command and arguments.
+func ParseQuotedLine(line string) (cmd string, cmdArgs []CmdArg, err error) {
+	return parseLine(line, options{quotedArgs: true})
+}
+
+// RenderDirective returns a directive line with the given command and
+// arguments, which ParseQuotedLine parses back into the same command and
+// arguments. Values are quoted where necessary. If sortArgs is set, the arguments are
+// sorted by name (preserving the order of arguments with the same name), so
+// that the line doesn't depend on the order in which they were added.
+func RenderDirective(cmd string, args []CmdArg, sortArgs bool) string {
+	if sortArgs {
+		args = append([]CmdArg(nil), args...)
+		sort.SliceStable(args, func(i, j int) bool { return args[i].Key < args[j].Key })
+	}
+	var buf strings.Builder
+	buf.WriteString(cmd)
+	for _, arg := range args {
+		buf.WriteString(" ")
+		buf.WriteString(arg.String())
+	}
+	return buf.String()
+}
+
+// parseLine implements ParseLine and ParseQuotedLine, according to the
+// AllowTrailingComma and QuotedArgs options.
+func parseLine(line string, opts options) (cmd string, cmdArgs []CmdArg, err error) {
 	line = strings.TrimSpace(line)
 	if line == "" {
 		return "", nil, nil
@@ -44,11 +89,11 @@ func ParseLine(line string) (cmd string, cmdArgs []CmdArg, err error) {
 
 	defer func() {
 		if r := recover(); r != nil {
-			if r == (parseError{}) {
+			if pe, ok := r.(parseError); ok {
 				column := len(origLine) - len(line) + 1
 				cmd = ""
 				cmdArgs = nil
-				err = fmt.Errorf("cannot parse directive at column %d: %s", column, origLine)
+				err = &directiveError{column: column, line: origLine, unterminated: pe.unterminated}
 				// Note: to debug an unexpected parsing error, this is a good place to
 				// add a debug.PrintStack().
 			} else {
@@ -77,7 +122,17 @@ func ParseLine(line string) (cmd string, cmdArgs []CmdArg, err error) {
 
 	for line != "" {
 		var arg CmdArg
-		arg.Key = until(" =")
+		if opts.quotedArgs && line[0] == '"' {
+			// Quoted key, which can contain spaces or '='.
+			key, n := unquotePrefix(line)
+			line = line[n:]
+			if key == "" || (line != "" && line[0] != ' ' && line[0] != '=') {
+				panic(parseError{})
+			}
+			arg.Key = key
+		} else {
+			arg.Key = until(" =")
+		}
 		if arg.Key == "" {
 			panic(parseError{})
 		}
@@ -88,6 +143,14 @@ func ParseLine(line string) (cmd string, cmdArgs []CmdArg, err error) {
 			if line == "" || line[0] == ' ' {
 				// Empty value.
 				arg.Vals = []string{""}
+			} else if opts.quotedArgs && line[0] == '"' {
+				// Quoted single value.
+				val, n := unquotePrefix(line)
+				line = line[n:]
+				if line != "" && line[0] != ' ' {
+					panic(parseError{})
+				}
+				arg.Vals = []string{val}
 			} else if line[0] != '(' {
 				// Single value.
 				val := until(" ")
@@ -103,7 +166,35 @@ func ParseLine(line string) (cmd string, cmdArgs []CmdArg, err error) {
 				for nestLevel > 0 {
 					if pos == len(line) {
 						// The string ended before we found the final ')'.
-						panic(parseError{})
+						panic(parseError{unterminated: true})
+					}
+					if opts.quotedArgs && pos == lastValStart && line[pos] == '"' {
+						// Quoted value. It must be followed by a top-level comma or the
+						// final ')'.
+						val, n := unquotePrefix(line[pos:])
+						arg.Vals = append(arg.Vals, val)
+						pos += n
+						for pos < len(line) && line[pos] == ' ' {
+							pos++
+						}
+						if pos == len(line) {
+							panic(parseError{unterminated: true})
+						}
+						switch line[pos] {
+						case ',':
+							pos++
+							for pos < len(line) && line[pos] == ' ' {
+								pos++
+							}
+							lastValStart = pos
+						case ')':
+							pos++
+							nestLevel = 0
+							lastValStart = -1
+						default:
+							panic(parseError{})
+						}
+						continue
 					}
 					r, runeSize := utf8.DecodeRuneInString(line[pos:])
 					pos += runeSize
@@ -124,7 +215,11 @@ func ParseLine(line string) (cmd string, cmdArgs []CmdArg, err error) {
 						nestLevel--
 					}
 				}
-				arg.Vals = append(arg.Vals, line[lastValStart:pos-1])
+				if lastVal := lastValStart; lastVal >= 0 {
+					if !opts.allowTrailingComma || lastVal == 1 || lastVal < pos-1 {
+						arg.Vals = append(arg.Vals, line[lastVal:pos-1])
+					}
+				}
 				line = strings.TrimSpace(line[pos:])
 			}
 		}
@@ -134,4 +229,98 @@ func ParseLine(line string) (cmd string, cmdArgs []CmdArg, err error) {
 	return cmd, cmdArgs, nil
 }
 
-type parseError struct{}
+// unquotePrefix parses the Go double-quoted string literal at the start of s,
+// returning its value and its length in s.
+func unquotePrefix(s string) (string, int) {
+	quoted, err := strconv.QuotedPrefix(s)
+	if err != nil {
+		panic(parseError{})
+	}
+	val, err := strconv.Unquote(quoted)
+	if err != nil {
+		panic(parseError{})
+	}
+	return val, len(quoted)
+}
+
+// quoteValue returns the value as it should appear on a directive line so that
+// ParseQuotedLine produces the same value again. The inList argument indicates
+// whether the value is part of a parenthesized list of values.
+func quoteValue(val string, inList bool) string {
+	if needsQuoting(val, inList) {
+		return strconv.Quote(val)
+	}
+	return val
+}
+
+// quoteKey returns the argument name as it should appear on a directive line
+// so that ParseQuotedLine produces the same name again.
+func quoteKey(key string) string {
+	if key == "" || key[0] == '"' || strings.ContainsAny(key, " =") ||
+		strconv.Quote(key) != `"`+key+`"` {
+		return strconv.Quote(key)
+	}
+	return key
+}
+
+func needsQuoting(val string, inList bool) bool {
+	if val == "" {
+		// An empty value is fine on its own ("arg="), but would be ambiguous
+		// inside a list.
+		return inList
+	}
+	if val[0] == '"' || strings.HasSuffix(val, `\`) || strconv.Quote(val) != `"`+val+`"` {
+		// Values that look quoted, would be mistaken for a line continuation or
+		// contain characters that need escaping.
+		return true
+	}
+	if !inList {
+		return val[0] == '(' || strings.Contains(val, " ")
+	}
+	if val[0] == ' ' {
+		// Spaces after a comma are skipped by the parser.
+		return true
+	}
+	// Top-level commas and unbalanced parens would confuse the parser.
+	nestLevel := 0
+	for _, r := range val {
+		switch r {
+		case ',':
+			if nestLevel == 0 {
+				return true
+			}
+		case '(':
+			nestLevel++
+		case ')':
+			nestLevel--
+			if nestLevel < 0 {
+				return true
+			}
+		}
+	}
+	return nestLevel != 0
+}
+
+type parseError struct {
+	// unterminated is set if the line ended before the closing paren of a list
+	// of values.
+	unterminated bool
+}
+
+// directiveError is the error returned by ParseLine.
+type directiveError struct {
+	column       int
+	line         string
+	unterminated bool
+}
+
+func (e *directiveError) Error() string {
+	return fmt.Sprintf("cannot parse directive at column %d: %s", e.column, e.line)
+}
+
+// isUnterminatedList returns true if the error was returned by ParseLine for
+// a line which ended inside a parenthesized list of values.
+func isUnterminatedList(err error) bool {
+	var de *directiveError
+	return errors.As(err, &de) && de.unterminated
+}
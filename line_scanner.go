@@ -22,6 +22,14 @@ import (
 type lineScanner struct {
 	*bufio.Scanner
 	line int
+	// text is the current line.
+	text string
+	// unscanned is set if the next call to Scan must return the current line
+	// again.
+	unscanned bool
+	// ahead contains the lines read by Peek, which are returned by the next
+	// calls to Scan.
+	ahead []string
 }
 
 func newLineScanner(r io.Reader) *lineScanner {
@@ -32,9 +40,52 @@ func newLineScanner(r io.Reader) *lineScanner {
 }
 
 func (l *lineScanner) Scan() bool {
+	if l.unscanned {
+		l.unscanned = false
+		l.line++
+		return true
+	}
+	if len(l.ahead) > 0 {
+		l.text = l.ahead[0]
+		l.ahead = l.ahead[1:]
+		l.line++
+		return true
+	}
 	ok := l.Scanner.Scan()
 	if ok {
 		l.line++
+		l.text = l.Scanner.Text()
 	}
 	return ok
 }
+
+// Text returns the current line.
+func (l *lineScanner) Text() string {
+	return l.text
+}
+
+// Peek returns the line which the i-th next call to Scan (starting at 0) will
+// return, without consuming it. The second return value is false if there is
+// no such line.
+func (l *lineScanner) Peek(i int) (string, bool) {
+	if l.unscanned {
+		if i == 0 {
+			return l.text, true
+		}
+		i--
+	}
+	for len(l.ahead) <= i {
+		if !l.Scanner.Scan() {
+			return "", false
+		}
+		l.ahead = append(l.ahead, l.Scanner.Text())
+	}
+	return l.ahead[i], true
+}
+
+// Unscan makes the next call to Scan return the current line again. It must
+// not be called twice without a call to Scan in between.
+func (l *lineScanner) Unscan() {
+	l.unscanned = true
+	l.line--
+}
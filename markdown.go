@@ -0,0 +1,100 @@
+// Copyright 2026 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var docDir = flag.String(
+	"datadriven-doc", "",
+	"if set, do not run the tests but write a Markdown rendering of each test file to "+
+		"<dir>/<path>.md, where <path> is the path of the test file relative to the current "+
+		"directory, without extension. The RenderDoc option is used if any. Cannot be "+
+		"combined with -rewrite.",
+)
+
+// writeDoc writes the Markdown rendering of the test file read from input to
+// the directory given by -datadriven-doc. The directives are not run.
+func writeDoc(t testing.TB, path string, input io.Reader, opts ...Option) error {
+	t.Helper()
+	o := makeOptions(opts)
+	render := o.renderDoc
+	if render == nil {
+		render = renderDocDefault
+	}
+
+	var buf bytes.Buffer
+	r := newTestDataReader(t, path, input, false /* record */, o)
+	for r.Next(t) {
+		if r.data.Cmd == "subtest" {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(withTrailingNewline(render(&r.data)))
+	}
+
+	out, err := docPath(path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(out, buf.Bytes(), 0644)
+}
+
+// docPath returns the path of the Markdown rendering of a test file. The
+// renderings mirror the paths of the test files relative to the current
+// directory, so that test files with the same name in different directories
+// (as found by Walk) don't overwrite each other's renderings. Test files
+// outside of the current directory are mirrored by absolute path.
+func docPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = strings.TrimPrefix(abs, filepath.VolumeName(abs))
+	}
+	return filepath.Join(*docDir, cutExt(rel)+".md"), nil
+}
+
+// renderDocDefault renders a directive as a fenced code block showing the
+// directive as it appears in the test file.
+func renderDocDefault(d *TestData) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "```\n%s\n", RenderDirective(d.Cmd, d.CmdArgs, false /* sortArgs */))
+	if d.Input != "" {
+		fmt.Fprintf(&buf, "%s\n", d.Input)
+	}
+	fmt.Fprintf(&buf, "----\n%s```\n", d.Expected)
+	return buf.String()
+}
@@ -0,0 +1,627 @@
+// Copyright 2026 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"testing"
+)
+
+// Option is an optional argument to RunTest and its variants, used to
+// customize how test files are parsed and checked.
+type Option func(*options)
+
+// options is the configuration resulting from a list of Options.
+type options struct {
+	formatPos func(file string, line int) string
+	userData  interface{}
+
+	strictSubTestNames bool
+	resultSink         func(Result)
+	collectOutputs     map[string]string
+	allowTrailingComma bool
+	quotedArgs         bool
+	tabContinuation    bool
+	comparators        map[string]Comparator
+	redactions         map[string][]Redaction
+	ignoreLinePrefixes []string
+	ignorePlaceholder  string
+	inlineComments     string
+	parallelDirectives bool
+	preprocessInput    func(cmd, input string) string
+	preprocessFile     func(name, contents string) (string, error)
+	defaultCmd         string
+	noRewriteHint      bool
+	expandEnv          bool
+	expandEnvStrict    bool
+	argRefs            bool
+	fileArgs           map[string]bool
+	sortArgs           bool
+	rejectTabs         bool
+	strictBlockEnd     bool
+	lazyExpected       bool
+	annotateRewrite    bool
+	appendAlternatives bool
+	httpClient         *http.Client
+	onSubTestStart     func(name string)
+	onSubTestEnd       func(name string)
+	optionalSeparator  bool
+	renderDoc          func(d *TestData) string
+	rewriteSink        func(path string) io.WriteCloser
+	activeKeys         map[string]bool
+	setupFile          string
+
+	// rewriteOut, if set, receives the rewritten contents of the test file as
+	// they are produced, instead of them being buffered.
+	rewriteOut io.Writer
+}
+
+// defaultIgnorePlaceholder is the default IgnorePlaceholder.
+const defaultIgnorePlaceholder = "[ignore]"
+
+func makeOptions(opts []Option) options {
+	o := options{ignorePlaceholder: defaultIgnorePlaceholder}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// FormatPos customizes how TestData.Pos is constructed from the name of the
+// test file and the line number of the directive. The default is "file:line".
+// This can be used to map virtual paths (e.g. of files loaded from an embed.FS)
+// back to locations that editors can navigate to.
+func FormatPos(fn func(file string, line int) string) Option {
+	return func(o *options) {
+		o.formatPos = fn
+	}
+}
+
+// UserData attaches an arbitrary value to the TestData of every directive, as
+// TestData.UserData. It can be used to hand handlers shared state needed for
+// determinism, like a seeded random number generator or a fake clock.
+func UserData(v interface{}) Option {
+	return func(o *options) {
+		o.userData = v
+	}
+}
+
+// StrictSubTestNames makes it an error for a subtest name to contain
+// characters that make it hard to target the subtest with go test -run, such as
+// spaces or regexp metacharacters. By default, such names only produce a
+// warning in the test log.
+func StrictSubTestNames() Option {
+	return func(o *options) {
+		o.strictSubTestNames = true
+	}
+}
+
+// Result describes the outcome of running a single directive. See ResultSink.
+type Result struct {
+	// Pos is the position of the directive, as in TestData.Pos.
+	Pos string `json:"pos"`
+	// Cmd is the command of the directive.
+	Cmd string `json:"cmd"`
+	// Passed is true if the actual results were as expected, or if they were
+	// recorded with -rewrite.
+	Passed bool `json:"passed"`
+	// Diff describes how the actual results differed from the expected
+	// results, if they did. It is never colored.
+	Diff string `json:"diff,omitempty"`
+}
+
+// ResultSink registers a function that is called with the Result of every
+// directive that was run, whether it passed or failed. This allows collecting
+// structured test results without scraping the test output.
+func ResultSink(fn func(Result)) Option {
+	return func(o *options) {
+		o.resultSink = fn
+	}
+}
+
+// JSONResults writes the Result of every directive that was run to w, as one
+// JSON object per line. Write errors are ignored.
+func JSONResults(w io.Writer) Option {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return ResultSink(func(res Result) {
+		_ = enc.Encode(res)
+	})
+}
+
+// CollectOutputs stores the actual results of every directive that was run in
+// m, by TestData.Pos, whether they were as expected or not (unless the
+// function itself failed the test). This allows
+// comparing the outputs of two runs without parsing the test files. The map
+// must not be nil; it is safe to read once the test has completed.
+func CollectOutputs(m map[string]string) Option {
+	return func(o *options) {
+		o.collectOutputs = m
+	}
+}
+
+// AllowTrailingComma makes a trailing comma in a list of argument values
+// (e.g. "arg=(a, b,)") acceptable, instead of it producing an empty final
+// value. This eases generating test files. With the QuotedArgs option, an
+// explicitly quoted empty value (e.g. "arg=(a, "")") is still preserved.
+func AllowTrailingComma() Option {
+	return func(o *options) {
+		o.allowTrailingComma = true
+	}
+}
+
+// QuotedArgs makes argument names and values on directive lines that start
+// with a double quote parse as Go string literals, as with ParseQuotedLine.
+// This allows values to contain spaces, commas or unbalanced parens, as in
+// sep=" " or vals=("a, b", ")"), and the lines written by RenderDirective to
+// be read back. It changes how existing test files with double quotes on
+// directive lines are read: without it, a="x y" is two arguments, a="x" has
+// the value "x" including the quotes, and unbalanced quotes are not an error.
+func QuotedArgs() Option {
+	return func(o *options) {
+		o.quotedArgs = true
+	}
+}
+
+// TabContinuation makes lines which start with a tab continue the directive
+// line preceding them, which allows listing arguments one per line:
+//
+//	build
+//		a=1
+//		b=(2, 3)
+//	----
+//
+// As a consequence, the input of a directive cannot start with a tab. The
+// lines are kept as is when rewriting.
+func TabContinuation() Option {
+	return func(o *options) {
+		o.tabContinuation = true
+	}
+}
+
+// Comparator compares the expected and actual results of a directive. If they
+// are not considered equal, it returns a description of their differences.
+type Comparator func(expected, actual string) (equal bool, diff string)
+
+// Comparators registers custom comparison functions by command. The results of
+// directives with one of these commands are compared using the corresponding
+// function instead of requiring an exact match; this can be used for outputs
+// with a looser notion of equality, such as JSON documents.
+func Comparators(m map[string]Comparator) Option {
+	return func(o *options) {
+		if o.comparators == nil {
+			o.comparators = make(map[string]Comparator, len(m))
+		}
+		for cmd, cmp := range m {
+			o.comparators[cmd] = cmp
+		}
+	}
+}
+
+// Redaction replaces the matches of a regular expression in the results of a
+// directive. See Redactions.
+type Redaction struct {
+	Re *regexp.Regexp
+	// Repl is the replacement text, which can refer to submatches as in
+	// regexp.Regexp.ReplaceAllString.
+	Repl string
+}
+
+// Redactions registers, by command, replacements applied to both the actual
+// and expected results of directives before they are compared, in order. This
+// scrubs nondeterministic parts of the results, like generated IDs:
+//
+//	Redactions(map[string][]Redaction{
+//		"insert": {{Re: regexp.MustCompile(`id=\d+`), Repl: "id=<redacted>"}},
+//	})
+//
+// The redacted actual results are written when rewriting.
+func Redactions(m map[string][]Redaction) Option {
+	return func(o *options) {
+		if o.redactions == nil {
+			o.redactions = make(map[string][]Redaction, len(m))
+		}
+		for cmd, reds := range m {
+			o.redactions[cmd] = append(o.redactions[cmd], reds...)
+		}
+	}
+}
+
+// InlineComments recognizes the lines of expected blocks which start with the
+// given prefix (for example "// note:") as annotations for reviewers. They are
+// removed from the expected results before comparison, so that the actual
+// results need not contain them, and are kept in place when rewriting.
+func InlineComments(prefix string) Option {
+	return func(o *options) {
+		o.inlineComments = prefix
+	}
+}
+
+// IgnoreLinePrefixes removes the lines which start with one of the given
+// prefixes from both the actual and expected results of every directive before
+// they are compared, and from the actual results written when rewriting. This
+// suits volatile lines, like "generated at ..." headers.
+func IgnoreLinePrefixes(prefixes ...string) Option {
+	return func(o *options) {
+		o.ignoreLinePrefixes = append(o.ignoreLinePrefixes, prefixes...)
+	}
+}
+
+// IgnorePlaceholder changes the expected results which cause the actual
+// results of a directive to never be checked. The default is "[ignore]". Such
+// directives still run, which is useful for informational outputs, and their
+// placeholder is kept when rewriting. An empty placeholder disables the
+// feature.
+func IgnorePlaceholder(placeholder string) Option {
+	return func(o *options) {
+		o.ignorePlaceholder = placeholder
+	}
+}
+
+// ParallelDirectives runs each top-level directive of a test file in its own
+// parallel subtest, which can speed up slow handlers. Directives inside
+// subtests still run sequentially. The parallel subtests are grouped in a
+// subtest named "parallel", so RunTest returns once they have all finished.
+//
+// The handler must be free of side effects that other directives could
+// observe: directives run in no particular order, after the directives in
+// subtests. For the same reason, labeled outputs cannot be referred to with
+// @same-as. The option has no effect when rewriting, since the results must
+// be written in order.
+func ParallelDirectives() Option {
+	return func(o *options) {
+		o.parallelDirectives = true
+	}
+}
+
+// PreprocessInput transforms the input of every directive before it is passed
+// to the handler, as TestData.Input. This can be used to expand macros in a
+// central place, keeping test files terse. The test file itself is not
+// affected when rewriting.
+func PreprocessInput(fn func(cmd, input string) string) Option {
+	return func(o *options) {
+		o.preprocessInput = fn
+	}
+}
+
+// PreprocessFile transforms the whole contents of every test file before it is
+// parsed, for example to expand a text/template with variables. The name is
+// that of the test file, as in TestData.File. An error fails the test. Since
+// the actual results could not be mapped back to the original file, this
+// option cannot be combined with -rewrite.
+func PreprocessFile(fn func(name, contents string) (string, error)) Option {
+	return func(o *options) {
+		o.preprocessFile = fn
+	}
+}
+
+// DefaultCmd allows directives without a command, which are passed to the
+// handler with the given command instead. A line where a directive is expected
+// has no command if it doesn't start with a word made of letters, digits,
+// '_', '.' or '-' (and not starting with a digit): such a line is the first
+// line of the input, or the separator of a directive without input. For
+// example, with DefaultCmd("eval"), the following directives are equivalent:
+//
+//	eval
+//	1 + 2
+//	----
+//	3
+//
+//	1 + 2
+//	----
+//	3
+//
+// Inputs which start with such a word still require the explicit command.
+func DefaultCmd(cmd string) Option {
+	return func(o *options) {
+		o.defaultCmd = cmd
+	}
+}
+
+// NoRewriteHint removes the hint about the -rewrite flag from the failure
+// messages of directives whose actual results don't match the expected
+// results. This suits teams which prefer expected results to be updated by
+// hand.
+func NoRewriteHint() Option {
+	return func(o *options) {
+		o.noRewriteHint = true
+	}
+}
+
+// ExpandEnvArgs replaces references to environment variables in argument
+// values, like $HOME or ${TMPDIR}, with their values (see os.ExpandEnv). This
+// is useful to refer to machine-specific paths. A literal dollar sign is
+// written as $$. Unset variables expand to the empty string, unless strict is
+// set, in which case they are an error.
+func ExpandEnvArgs(strict bool) Option {
+	return func(o *options) {
+		o.expandEnv = true
+		o.expandEnvStrict = strict
+	}
+}
+
+// ArgRefs allows argument values to refer to the value of another argument of
+// the same directive, as in "cmd a=foo b=@a", where b has the value foo. It is
+// an error for the referred argument to be missing or to have several values.
+// Without this option, values starting with @ are taken literally.
+func ArgRefs() Option {
+	return func(o *options) {
+		o.argRefs = true
+	}
+}
+
+// FileArgs declares arguments whose value is the name of a file, like
+// input-file=foo.txt, which keeps large fixtures out of test files. The file
+// is read when the directive is parsed, relative to the directory of the test
+// file unless its name is absolute, and its contents are available through
+// TestData.ArgFile. It is an error for the file not to exist.
+func FileArgs(keys ...string) Option {
+	return func(o *options) {
+		if o.fileArgs == nil {
+			o.fileArgs = make(map[string]bool, len(keys))
+		}
+		for _, key := range keys {
+			o.fileArgs[key] = true
+		}
+	}
+}
+
+// SortArgs sorts the arguments of every directive by name, in TestData.CmdArgs,
+// so that handlers see them in a canonical order. Arguments with the same name
+// and the values of each argument keep their order. This affects handlers
+// which depend on the position of arguments. The test file is not affected
+// when rewriting.
+func SortArgs() Option {
+	return func(o *options) {
+		o.sortArgs = true
+	}
+}
+
+// RejectTabs makes it an error for the expected or actual results of a
+// directive to contain tabs, which are easily confused with spaces and cause
+// mismatches that are hard to see. With -rewrite, only the actual results are
+// checked, so that expected results containing tabs can be replaced.
+func RejectTabs() Option {
+	return func(o *options) {
+		o.rejectTabs = true
+	}
+}
+
+// LazyExpected defers reading the expected results of each directive until
+// they are compared with the actual results, so that large expected results
+// are not held in memory while the handler runs, and are not kept at all for
+// directives which fail or are skipped. TestData.Expected is then empty in the
+// handler, which must call TestData.ExpectedString to read the expected
+// results. In particular, a handler returning d.Expected to signal that nothing
+// has changed returns the empty string instead, and fails. The option has no
+// effect when rewriting or with ParallelDirectives.
+func LazyExpected() Option {
+	return func(o *options) {
+		o.lazyExpected = true
+	}
+}
+
+// StrictBlockEnd makes it an error for a double separator section to reach the
+// end of the test file without its closing separators. By default, such a
+// section extends to the end of the file, and is closed when rewriting.
+func StrictBlockEnd() Option {
+	return func(o *options) {
+		o.strictBlockEnd = true
+	}
+}
+
+// AnnotateRewrite makes rewrites precede the expected results of every
+// directive with a comment line repeating the directive, like:
+//
+//	# output of: build a=1
+//	----
+//
+// This helps keep track of the directive when reviewing the diffs of long
+// expected results. Such a line is not part of the input of the directive,
+// and is written again on the next rewrite.
+func AnnotateRewrite() Option {
+	return func(o *options) {
+		o.annotateRewrite = true
+	}
+}
+
+// AppendAlternatives changes how the expected results of directives with the
+// one-of meta-argument are rewritten when the actual results match none of
+// the alternatives: the actual results are added as a new alternative, instead
+// of replacing the expected results.
+func AppendAlternatives() Option {
+	return func(o *options) {
+		o.appendAlternatives = true
+	}
+}
+
+// OnSubTestStart registers a function which is called at the start of every
+// subtest, with its full name (including the names of the parent subtests).
+// Along with OnSubTestEnd, it can be used to manage per-subtest resources.
+func OnSubTestStart(fn func(name string)) Option {
+	return func(o *options) {
+		o.onSubTestStart = fn
+	}
+}
+
+// OnSubTestEnd registers a function which is called at the end of every
+// subtest, with its full name. It is called even if the subtest fails.
+func OnSubTestEnd(fn func(name string)) Option {
+	return func(o *options) {
+		o.onSubTestEnd = fn
+	}
+}
+
+// OptionalSeparator allows directives without expected results, which is
+// convenient for commands run only for their side effects. The input of a
+// directive ends at the first blank line (or at the end of the file) if no
+// "----" separator comes first; such a directive runs without its results
+// being checked, and is left as is when rewriting. As a consequence, inputs
+// cannot contain blank lines.
+func OptionalSeparator() Option {
+	return func(o *options) {
+		o.optionalSeparator = true
+	}
+}
+
+// RenderDoc customizes the Markdown rendering of directives written when
+// running with -datadriven-doc=<dir>, which writes the rendering of every test
+// file to <dir>/<file>.md instead of running the tests. This keeps
+// documentation generated from test files in sync with them. By default, each
+// directive is rendered as a fenced code block.
+func RenderDoc(fn func(d *TestData) string) Option {
+	return func(o *options) {
+		o.renderDoc = fn
+	}
+}
+
+// RewriteSink redirects the output of -rewrite: instead of replacing a test
+// file whose results changed, its regenerated contents are written to the
+// writer returned by fn for the path of the file, which is then closed. This
+// allows gating updates to the expected results, for example by writing them
+// to a separate directory for review.
+func RewriteSink(fn func(path string) io.WriteCloser) Option {
+	return func(o *options) {
+		o.rewriteSink = fn
+	}
+}
+
+// ActiveKeys sets the keys which select between conditional expected blocks,
+// for results which legitimately differ, for example by platform. A directive
+// can have several expected blocks, each preceded by a separator with a key
+// and separated by blank lines:
+//
+//	print-path
+//	----
+//	a/b
+//
+//	---- if=windows
+//	a\b
+//
+// The block compared with the actual results is the first one whose key is
+// active, or else the one preceded by a plain separator (which must come
+// first), if any. When rewriting, only that block is updated. For example:
+//
+//	datadriven.ActiveKeys(runtime.GOOS, runtime.GOARCH)
+func ActiveKeys(keys ...string) Option {
+	return func(o *options) {
+		if o.activeKeys == nil {
+			o.activeKeys = make(map[string]bool, len(keys))
+		}
+		for _, key := range keys {
+			o.activeKeys[key] = true
+		}
+	}
+}
+
+// Setup runs the directives of the test file at the given path before those of
+// every test file, with the same function, to establish common state. Their
+// results are not checked, and the setup file is never rewritten. Along with
+// the SetupFile walk option, this allows a shared preamble for a directory
+// tree:
+//
+//	datadriven.Walk(t, "testdata", func(t *testing.T, path string) {
+//	  datadriven.RunTest(t, path, handler, datadriven.Setup("testdata/_setup"))
+//	}, datadriven.SetupFile("_setup"))
+func Setup(path string) Option {
+	return func(o *options) {
+		o.setupFile = path
+	}
+}
+
+// HTTPClient sets the client used by RunTestFromURL to fetch test files, which
+// allows configuring timeouts or authentication. By default, a client with a
+// 30s timeout is used.
+func HTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = client
+	}
+}
+
+// WalkOption is an optional argument to Walk and its variants.
+type WalkOption func(*walkOptions)
+
+// walkOptions is the configuration resulting from a list of WalkOptions.
+type walkOptions struct {
+	isLeaf   func(path string, info os.FileInfo) bool
+	glob     string
+	handlers []walkHandler
+	skip     map[string]bool
+}
+
+// walkHandler is a function registered with WalkHandler.
+type walkHandler struct {
+	match func(path string) bool
+	fn    func(t testing.TB, path string)
+}
+
+func makeWalkOptions(opts []WalkOption) walkOptions {
+	var o walkOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// IsLeaf declares some directories as leaves of the walk: the walk function
+// is called once with the path of each directory for which fn returns true,
+// instead of descending into it. This allows test cases made of several
+// files. Files are always leaves.
+func IsLeaf(fn func(path string, info os.FileInfo) bool) WalkOption {
+	return func(o *walkOptions) {
+		o.isLeaf = fn
+	}
+}
+
+// Glob makes the walk skip the leaves whose path relative to the walked
+// directory doesn't match the given pattern (see filepath.Match), as in
+// "logprops/*". This focuses a run on some test files without restructuring
+// directories. The -datadriven-glob flag has the same effect; if both are
+// set, leaves must match both patterns.
+func Glob(pattern string) WalkOption {
+	return func(o *walkOptions) {
+		o.glob = pattern
+	}
+}
+
+// WalkHandler calls fn instead of the function passed to Walk for the leaves
+// whose path satisfies match. This allows dispatching the files of a
+// heterogeneous tree to different handlers, like files under sql/ and kv/.
+// If several WalkHandlers match a leaf, the first one wins. With Walk and
+// WalkWithState, t is a *testing.T. The per-directory state of WalkWithState
+// is not passed to fn.
+func WalkHandler(match func(path string) bool, fn func(t testing.TB, path string)) WalkOption {
+	return func(o *walkOptions) {
+		o.handlers = append(o.handlers, walkHandler{match: match, fn: fn})
+	}
+}
+
+// SetupFile makes the walk skip the file with the given name at the root of
+// the walked directory, which is meant to be passed to RunTest with the Setup
+// option rather than run as a test file. Since the Setup option runs a single
+// file, a file with the same name in a subdirectory is an error, rather than
+// being silently ignored.
+func SetupFile(name string) WalkOption {
+	return func(o *walkOptions) {
+		if o.skip == nil {
+			o.skip = make(map[string]bool)
+		}
+		o.skip[name] = true
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2026 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// defaultHTTPTimeout is the timeout of the HTTP client used by RunTestFromURL
+// if none is given with the HTTPClient option.
+const defaultHTTPTimeout = 30 * time.Second
+
+// RunTestFromURL is a version of RunTest which fetches the contents of the test
+// over HTTP(S), for example from a conformance suite shared across
+// repositories. The HTTP client can be configured with the HTTPClient option.
+// The test cannot be rewritten: with -rewrite, the results are checked as
+// usual.
+func RunTestFromURL(
+	t *testing.T, url string, f func(t *testing.T, d *TestData) string, opts ...Option,
+) {
+	t.Helper()
+	client := makeOptions(opts).httpClient
+	if client == nil {
+		client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: unexpected status %s", url, resp.Status)
+	}
+	input, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *rewriteTestFiles {
+		t.Logf("%s: remote test files cannot be rewritten; checking the results instead", url)
+	}
+	runTestInternal(t, url, bytes.NewReader(input), func(t testing.TB, d *TestData) string {
+		return f(t.(*testing.T), d)
+	}, false /* rewrite */, opts...)
+}
@@ -0,0 +1,78 @@
+// Copyright 2026 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"strings"
+	"testing"
+)
+
+// DirectiveSource supplies directives programmatically, for example from a
+// property-based generator, instead of parsing them from a test file. See
+// RunTestFromSource.
+type DirectiveSource interface {
+	// Next returns the next directive to run. The second return value is
+	// false once there are no more directives.
+	Next() (*TestData, bool)
+}
+
+// directiveSourceName is the name used in the positions of the directives
+// supplied by a DirectiveSource.
+const directiveSourceName = "<source>"
+
+// RunTestFromSource is a version of RunTest which runs the directives supplied
+// by a DirectiveSource. Their actual results are checked against their
+// Expected field as with RunTest, including meta-arguments. A final newline is
+// added to Expected if missing, and directives without a Pos are given one of
+// the form <source>:<n> for the nth directive. Subtest directives are not
+// supported. Nothing can be rewritten: with -rewrite, the results are checked
+// as usual.
+func RunTestFromSource(
+	t *testing.T, source DirectiveSource, f func(t *testing.T, d *TestData) string, opts ...Option,
+) {
+	t.Helper()
+	if *rewriteTestFiles {
+		t.Logf("directives from a DirectiveSource cannot be rewritten; checking the results instead")
+	}
+	r := newTestDataReader(
+		t, directiveSourceName, strings.NewReader(""), false /* record */, makeOptions(opts),
+	)
+	handler := func(t testing.TB, d *TestData) string {
+		return f(t.(*testing.T), d)
+	}
+	for {
+		d, ok := source.Next()
+		if !ok {
+			return
+		}
+		r.directiveCount++
+		r.data = *d
+		if r.data.Pos == "" {
+			r.data.Pos = r.pos(r.directiveCount)
+		}
+		if r.data.File == "" {
+			r.data.File = directiveSourceName
+		}
+		if r.data.Cmd == "subtest" {
+			r.data.Fatalf(t, "subtest directives are not supported by RunTestFromSource")
+		}
+		if r.data.UserData == nil {
+			r.data.UserData = r.opts.userData
+		}
+		r.data.Expected = withTrailingNewline(r.data.Expected)
+		r.data.recall = r.recall
+		runDirective(t, r, &r.data, handler)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2026 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseTable splits an output into rows of cells, for directives with the
+// table meta-argument. Cells are delimited by pipes if the output contains
+// any, and by whitespace otherwise. Blank lines and borders (see isBorder) are
+// skipped. The second return value is true if the cells are delimited by
+// pipes.
+func parseTable(output string) (rows [][]string, pipes bool) {
+	pipes = strings.Contains(output, "|")
+	// afterHeader is set once the line following the first row, which may be
+	// a header separator, has been read.
+	afterHeader := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		headerSep := len(rows) == 1 && !afterHeader
+		afterHeader = afterHeader || len(rows) == 1
+		if isBorder(line, headerSep) {
+			continue
+		}
+		if !pipes {
+			rows = append(rows, strings.Fields(line))
+			continue
+		}
+		line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+		cells := strings.Split(line, "|")
+		for i := range cells {
+			cells[i] = strings.TrimSpace(cells[i])
+		}
+		rows = append(rows, cells)
+	}
+	return rows, pipes
+}
+
+// isBorder returns true if a line of a table is a border: either runs of '-'
+// or '=' joined by '+' or pipes, as in "+----+----+" or "---+---", or, for the
+// header separator following the first row, such runs of at least two
+// characters padded with spaces, as in "| --- | --- |" or "---  ----". Other
+// lines made of these characters are rows, like those of "-" cells often used
+// for NULL values.
+func isBorder(line string, headerSep bool) bool {
+	if strings.Trim(line, "-+=|") == "" {
+		return true
+	}
+	if !headerSep || strings.Trim(line, "-+=| \t") != "" {
+		return false
+	}
+	for _, run := range strings.FieldsFunc(line, func(r rune) bool {
+		return strings.ContainsRune("+| \t", r)
+	}) {
+		if len(run) < 2 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTable verifies that the actual output has the same cells as the
+// expected output, regardless of alignment.
+func checkTable(d *TestData, expected, actual string) string {
+	expectedRows, _ := parseTable(expected)
+	actualRows, _ := parseTable(actual)
+	for i := 0; i < len(expectedRows) || i < len(actualRows); i++ {
+		if i >= len(expectedRows) || i >= len(actualRows) {
+			return fmt.Sprintf("%s: expected %d rows, found %d:%s",
+				showPos(d.Pos), len(expectedRows), len(actualRows), mismatch(d, expected, actual))
+		}
+		e, a := expectedRows[i], actualRows[i]
+		for j := 0; j < len(e) || j < len(a); j++ {
+			var ec, ac string
+			if j < len(e) {
+				ec = e[j]
+			}
+			if j < len(a) {
+				ac = a[j]
+			}
+			if j >= len(e) || j >= len(a) || ec != ac {
+				return fmt.Sprintf("%s: row %d, column %d: expected %q, found %q:%s",
+					showPos(d.Pos), i+1, j+1, ec, ac, mismatch(d, expected, actual))
+			}
+		}
+	}
+	return ""
+}
+
+// renderTable renders the actual output of a directive with the table
+// meta-argument as an aligned table, as written when rewriting. Borders are
+// not preserved.
+func renderTable(actual string) string {
+	rows, pipes := parseTable(actual)
+	if len(rows) == 0 {
+		return actual
+	}
+	var widths []int
+	for _, row := range rows {
+		for j, cell := range row {
+			if j == len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := len([]rune(cell)); n > widths[j] {
+				widths[j] = n
+			}
+		}
+	}
+	sep := "  "
+	if pipes {
+		sep = " | "
+	}
+	var buf strings.Builder
+	for _, row := range rows {
+		var line strings.Builder
+		for j, cell := range row {
+			if j > 0 {
+				line.WriteString(sep)
+			}
+			line.WriteString(cell)
+			if j < len(row)-1 {
+				line.WriteString(strings.Repeat(" ", widths[j]-len([]rune(cell))))
+			}
+		}
+		buf.WriteString(strings.TrimRight(line.String(), " "))
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
@@ -18,20 +18,103 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// Reporter is the subset of testing.TB used to report errors while parsing
+// test files and checking actual results against expected results. It allows
+// using these parts of the framework outside of Go tests, for example in a
+// tool that validates test files.
+//
+// Like testing.TB.Fatalf, Fatalf must not return; implementations used
+// outside of tests will typically panic.
+type Reporter interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+}
+
+// ParseError describes a malformed test file. It is the error returned by
+// ParseTestData and ParseForFuzz.
+type ParseError struct {
+	// Pos is the position of the problem, as in TestData.Pos.
+	Pos string
+	// Kind is the kind of problem.
+	Kind ParseErrorKind
+	// Msg describes the problem.
+	Msg string
+}
+
+// ParseErrorKind classifies ParseErrors.
+type ParseErrorKind string
+
+const (
+	// ErrDirective is the kind of errors for directive lines which cannot be
+	// parsed.
+	ErrDirective ParseErrorKind = "directive"
+	// ErrUnterminatedBlock is the kind of errors for double separator
+	// sections which are not terminated before the end of the file, with the
+	// StrictBlockEnd option.
+	ErrUnterminatedBlock ParseErrorKind = "unterminated-block"
+	// ErrTrailingLine is the kind of errors for non-blank lines following the
+	// end of a double separator section.
+	ErrTrailingLine ParseErrorKind = "trailing-line"
+	// ErrArgument is the kind of errors for argument values which cannot be
+	// expanded or read, as configured by ExpandEnvArgs, ArgRefs or FileArgs.
+	ErrArgument ParseErrorKind = "argument"
+)
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %s", showPos(e.Pos), e.Msg)
+}
+
+// parseErrorf reports a ParseError through t.
+func parseErrorf(t Reporter, pos string, kind ParseErrorKind, format string, args ...interface{}) {
+	t.Helper()
+	t.Fatalf("%s", &ParseError{Pos: pos, Kind: kind, Msg: fmt.Sprintf(format, args...)})
+}
+
 type testDataReader struct {
 	sourceName string
 	reader     io.Reader
 	scanner    *lineScanner
 	data       TestData
 	rewrite    *bytes.Buffer
+	opts       options
+	// check is set when the file is regenerated with -datadriven-check, to be
+	// compared with its contents instead of being written.
+	check bool
+	// lazyExpected is set if the expected results of directives are only read
+	// once needed; see LazyExpected.
+	lazyExpected bool
+	// discardExpected is set while reading past expected results which are
+	// not needed, so that they are not kept.
+	discardExpected bool
+	// outputs contains the actual output of directives with a label
+	// meta-argument, by label.
+	outputs map[string]string
+	// directiveCount is the 1-based index of the last directive returned by
+	// Next, not counting subtest directives.
+	directiveCount int
+	// subTests is the stack of subtests being run, innermost last.
+	subTests []openSubTest
+	// resultMu serializes calls to the ResultSink and updates of the
+	// CollectOutputs map for parallel directives, and protects ran and passed.
+	resultMu sync.Mutex
+	// ran is the number of directives that were run, and passed the number of
+	// those whose results were as expected.
+	ran, passed int
 }
 
 func newTestDataReader(
-	t testing.TB, sourceName string, file io.Reader, record bool,
+	t Reporter, sourceName string, file io.Reader, record bool, opts options,
 ) *testDataReader {
 	t.Helper()
 
@@ -44,11 +127,16 @@ func newTestDataReader(
 		reader:     file,
 		scanner:    newLineScanner(file),
 		rewrite:    rewrite,
+		opts:       opts,
 	}
 }
 
-func (r *testDataReader) Next(t testing.TB) bool {
+func (r *testDataReader) Next(t Reporter) bool {
 	t.Helper()
+	r.flushRewrite(t)
+	// The expected results of the previous directive, if they haven't been
+	// loaded, were not needed, but must be read past to get to the next one.
+	r.skipExpected()
 
 	for r.scanner.Scan() {
 		// Ensure to not re-initialize r.data unless a line is read
@@ -61,15 +149,40 @@ func (r *testDataReader) Next(t testing.TB) bool {
 
 		// Update Pos early so that a late error message has an updated
 		// position.
-		pos := fmt.Sprintf("%s:%d", r.sourceName, r.scanner.line)
+		pos := r.pos(r.scanner.line)
 		r.data.Pos = pos
+		r.data.File = r.sourceName
 
 		line = strings.TrimSpace(line)
 		if strings.HasPrefix(line, "#") {
+			if r.isAnnotation(r.scanner.Text()) && r.rewrite != nil {
+				// Take back the annotation of a directive without input (with
+				// DefaultCmd), which is emitted again along with the actual
+				// output.
+				r.rewrite.Truncate(r.rewrite.Len() - len(r.scanner.Text()) - 1)
+			}
 			// Skip comment lines.
 			continue
 		}
 
+		if r.opts.defaultCmd != "" && line != "" && !commandRe.MatchString(line) {
+			// The line does not start with a command, so it is either the
+			// separator of a directive without input or the first line of
+			// the input of the default command.
+			r.data.Cmd = r.opts.defaultCmd
+			var buf bytes.Buffer
+			separator := isSeparator(line)
+			if !separator {
+				fmt.Fprintln(&buf, r.scanner.Text())
+			} else if r.rewrite != nil {
+				// Take back the separator, which is emitted again along with
+				// the actual output.
+				r.rewrite.Truncate(r.rewrite.Len() - len(r.scanner.Text()) - 1)
+			}
+			r.readBody(t, &buf, separator)
+			return true
+		}
+
 		// Support wrapping directive lines using \, for example:
 		//   build-scalar \
 		//   vars(int)
@@ -78,15 +191,61 @@ func (r *testDataReader) Next(t testing.TB) bool {
 			r.emit(nextLine)
 			line = strings.TrimSuffix(line, `\`) + " " + strings.TrimSpace(nextLine)
 		}
+		if r.opts.tabContinuation {
+			// Support continuing directive lines with tab-indented lines, for
+			// example:
+			//   build-scalar
+			//   	vars(int)
+			for {
+				nextLine, ok := r.scanner.Peek(0)
+				if !ok || !strings.HasPrefix(nextLine, "\t") {
+					break
+				}
+				r.scanner.Scan()
+				r.emit(nextLine)
+				line += " " + strings.TrimSpace(nextLine)
+			}
+		}
 
-		cmd, args, err := ParseLine(line)
+		cmd, args, err := parseLine(line, r.opts)
+		// Support lists of values spanning multiple lines, for example:
+		//   build cols=(
+		//     a, b,
+		//     c
+		//   )
+		for isUnterminatedList(err) && r.scanner.Scan() {
+			nextLine := r.scanner.Text()
+			r.emit(nextLine)
+			nextLine = strings.TrimSpace(nextLine)
+			if nextLine == "" || isSeparator(nextLine) {
+				break
+			}
+			if strings.HasSuffix(line, "(") || strings.HasPrefix(nextLine, ")") {
+				line += nextLine
+			} else {
+				line += " " + nextLine
+			}
+			cmd, args, err = parseLine(line, r.opts)
+		}
 		if err != nil {
-			t.Fatalf("%s: %v", pos, err)
+			parseErrorf(t, pos, ErrDirective, "%v", err)
 		}
 		if cmd == "" {
 			// Nothing to do here.
 			continue
 		}
+		if r.opts.expandEnv {
+			r.expandEnvArgs(t, args)
+		}
+		if r.opts.argRefs {
+			r.resolveArgRefs(t, args)
+		}
+		if len(r.opts.fileArgs) > 0 {
+			r.readFileArgs(t, args)
+		}
+		if r.opts.sortArgs {
+			sort.SliceStable(args, func(i, j int) bool { return args[i].Key < args[j].Key })
+		}
 
 		r.data.Cmd = cmd
 		r.data.CmdArgs = args
@@ -96,78 +255,182 @@ func (r *testDataReader) Next(t testing.TB) bool {
 			return true
 		}
 
-		var buf bytes.Buffer
-		var separator bool
-		for r.scanner.Scan() {
-			line := r.scanner.Text()
-			if line == "----" {
-				separator = true
-				break
-			}
+		r.readBody(t, &bytes.Buffer{}, false /* separator */)
+		return true
+	}
+	return false
+}
+
+// readBody reads the input and expected output of the directive whose
+// directive line has just been read. The input read so far is in buf, and
+// separator indicates whether the separator preceding the expected output has
+// been read already.
+func (r *testDataReader) readBody(t Reporter, buf *bytes.Buffer, separator bool) {
+	r.directiveCount++
 
-			r.emit(line)
-			fmt.Fprintln(&buf, line)
+	// Directives with the silent meta-argument don't need expected results.
+	optionalSeparator := r.opts.optionalSeparator || r.data.hasMetaFlag("silent")
+	sepLine := "----"
+	// inputStart is the line number of the first line of the input, which
+	// excludes leading blank lines.
+	inputStart := 0
+	if strings.TrimSpace(buf.String()) != "" {
+		inputStart = r.scanner.line
+	}
+	for !separator && r.scanner.Scan() {
+		line := r.scanner.Text()
+		if _, ok := conditionalSeparator(line); ok || isSeparator(line) {
+			separator = true
+			sepLine = line
+			break
+		}
+
+		if r.isAnnotation(line) {
+			// The annotation is not part of the input, and is emitted again
+			// along with the actual output.
+			continue
 		}
+		r.emit(line)
+		if optionalSeparator && strings.TrimSpace(line) == "" {
+			// The directive has no expected results.
+			break
+		}
+		if inputStart == 0 && strings.TrimSpace(line) != "" {
+			inputStart = r.scanner.line
+		}
+		fmt.Fprintln(buf, line)
+	}
 
-		r.data.Input = strings.TrimSpace(buf.String())
+	r.data.Input = strings.TrimSpace(buf.String())
+	if inputStart > 0 {
+		r.data.inputPos = func(line int) string { return r.pos(inputStart + line - 1) }
+	}
 
-		if separator {
+	if separator && r.lazyExpected {
+		r.data.loadExpected = func() {
+			r.data.loadExpected = nil
 			r.readExpected(t)
+			r.readVariants(t, sepLine)
 		}
+	} else if separator {
+		r.readExpected(t)
+		r.readVariants(t, sepLine)
+	} else if optionalSeparator {
+		r.data.noExpected = true
+	}
 
-		r.data.Rewrite = *rewriteTestFiles
-		return true
+	r.data.Rewrite = r.rewrite != nil
+	r.data.UserData = r.opts.userData
+	r.data.peek = r.peekCmd
+	r.data.recall = r.recall
+}
+
+// skipExpected reads past the expected results of the current directive if
+// they haven't been loaded yet (see LazyExpected), without keeping them.
+func (r *testDataReader) skipExpected() {
+	if r.data.loadExpected == nil {
+		return
+	}
+	r.discardExpected = true
+	defer func() { r.discardExpected = false }()
+	r.data.loadExpected()
+}
+
+// peekCmd returns the command of the next directive, without consuming it.
+func (r *testDataReader) peekCmd() (string, bool) {
+	if r.data.loadExpected != nil {
+		// Skip the expected results of the current directive.
+		r.data.loadExpected()
+	}
+	for i := 0; ; i++ {
+		line, ok := r.scanner.Peek(i)
+		if !ok {
+			return "", false
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if r.opts.defaultCmd != "" && !commandRe.MatchString(line) {
+			return r.opts.defaultCmd, true
+		}
+		return strings.Fields(line)[0], true
 	}
-	return false
 }
 
-func (r *testDataReader) readExpected(t testing.TB) {
+func (r *testDataReader) readExpected(t Reporter) {
 	var buf bytes.Buffer
 	var line string
 	var allowBlankLines bool
 
-	if r.scanner.Scan() {
+	// raw accumulates the lines of the expected block as they appear in the
+	// file, so that the block can be preserved verbatim on rewrite. The blank
+	// line terminating the block is not included.
+	var raw []string
+	scan := func() bool {
+		if !r.scanner.Scan() {
+			return false
+		}
+		if !r.discardExpected {
+			raw = append(raw, r.scanner.Text())
+		}
+		return true
+	}
+	add := func(line string) {
+		if !r.discardExpected {
+			fmt.Fprintln(&buf, unescapeSeparator(line))
+		}
+	}
+
+	if scan() {
 		line = r.scanner.Text()
-		if line == "----" {
+		if isSeparator(line) {
 			allowBlankLines = true
 		}
 	}
 
 	if allowBlankLines {
 		// Look for two successive lines of "----" before terminating.
-		for r.scanner.Scan() {
+		terminated := false
+		for !terminated && scan() {
 			line = r.scanner.Text()
 
-			if line == "----" {
-				if r.scanner.Scan() {
+			if isSeparator(line) {
+				if scan() {
 					line2 := r.scanner.Text()
-					if line2 == "----" {
+					if isSeparator(line2) {
 						// Read the following blank line (if we don't do this, we will emit
 						// an extra blank line when rewriting).
-						if r.scanner.Scan() && r.scanner.Text() != "" {
-							t.Fatal("non-blank line after end of double ---- separator section")
-						}
-						break
+						r.readBlockEnd(t)
+						terminated = true
+						continue
 					}
 
-					fmt.Fprintln(&buf, line)
-					fmt.Fprintln(&buf, line2)
+					add(line)
+					add(line2)
 					continue
 				}
 			}
 
-			fmt.Fprintln(&buf, line)
+			add(line)
+		}
+		if !terminated && r.opts.strictBlockEnd {
+			parseErrorf(t, r.data.Pos, ErrUnterminatedBlock,
+				"EOF encountered before the end of the double ---- separator section")
 		}
 	} else {
 		// Terminate on first blank line.
 		for {
 			if strings.TrimSpace(line) == "" {
+				if len(raw) > 0 {
+					raw = raw[:len(raw)-1]
+				}
 				break
 			}
 
-			fmt.Fprintln(&buf, line)
+			add(line)
 
-			if !r.scanner.Scan() {
+			if !scan() {
 				break
 			}
 
@@ -176,6 +439,355 @@ func (r *testDataReader) readExpected(t testing.TB) {
 	}
 
 	r.data.Expected = buf.String()
+	r.data.rawExpected = raw
+}
+
+// expectedVariant is one of the expected blocks of a directive with
+// conditional expected results; see ActiveKeys.
+type expectedVariant struct {
+	// separator is the separator line preceding the block.
+	separator string
+	// key is the key of the block, or the empty string for the default block.
+	key         string
+	expected    string
+	rawExpected []string
+}
+
+// readVariants reads the conditional expected blocks which follow the
+// expected block that has just been read, if any, and selects the block that
+// applies according to ActiveKeys. The separator preceding the first block is
+// given by sepLine.
+func (r *testDataReader) readVariants(t Reporter, sepLine string) {
+	key, conditional := conditionalSeparator(sepLine)
+	variants := []expectedVariant{{
+		separator:   sepLine,
+		key:         key,
+		expected:    r.data.Expected,
+		rawExpected: r.data.rawExpected,
+	}}
+	for {
+		line, ok := r.scanner.Peek(0)
+		if !ok {
+			break
+		}
+		key, ok := conditionalSeparator(line)
+		if !ok {
+			break
+		}
+		r.scanner.Scan()
+		r.readExpected(t)
+		variants = append(variants, expectedVariant{
+			separator:   line,
+			key:         key,
+			expected:    r.data.Expected,
+			rawExpected: r.data.rawExpected,
+		})
+	}
+	if len(variants) == 1 && !conditional {
+		return
+	}
+
+	r.data.variants = variants
+	r.data.activeVariant = -1
+	for i, v := range variants {
+		if v.key == "" && r.data.activeVariant == -1 {
+			// Use the default block unless a keyed block applies.
+			r.data.activeVariant = i
+		} else if v.key != "" && r.opts.activeKeys[v.key] {
+			r.data.activeVariant = i
+			break
+		}
+	}
+	r.data.Expected, r.data.rawExpected = "", nil
+	if i := r.data.activeVariant; i >= 0 {
+		r.data.Expected, r.data.rawExpected = variants[i].expected, variants[i].rawExpected
+	}
+}
+
+// readBlockEnd reads the line following the end of a double separator
+// section, which must be blank or a comment, or the end of the file.
+func (r *testDataReader) readBlockEnd(t Reporter) {
+	t.Helper()
+	if !r.scanner.Scan() {
+		return
+	}
+	line := strings.TrimSpace(r.scanner.Text())
+	if strings.HasPrefix(line, "#") {
+		// Leave the comment to Next.
+		r.scanner.Unscan()
+	} else if line != "" {
+		parseErrorf(t, r.pos(r.scanner.line), ErrTrailingLine,
+			"non-blank line after end of double ---- separator section: %s", line)
+	}
+}
+
+// reportResult passes the result of a directive to the ResultSink, if any.
+func (r *testDataReader) reportResult(res Result) {
+	r.resultMu.Lock()
+	defer r.resultMu.Unlock()
+	r.ran++
+	if res.Passed {
+		r.passed++
+	}
+	if r.opts.resultSink != nil {
+		r.opts.resultSink(res)
+	}
+}
+
+// collectOutput adds the actual output of a directive to the map given with
+// the CollectOutputs option, if any.
+func (r *testDataReader) collectOutput(d *TestData, actual string) {
+	if r.opts.collectOutputs == nil {
+		return
+	}
+	r.resultMu.Lock()
+	defer r.resultMu.Unlock()
+	r.opts.collectOutputs[d.Pos] = actual
+}
+
+// logSummary logs the number of directives of the file that were run and how
+// many of them passed, along with the time it took.
+func (r *testDataReader) logSummary(t testing.TB, elapsed time.Duration) {
+	t.Helper()
+	r.resultMu.Lock()
+	defer r.resultMu.Unlock()
+	t.Logf("%s: %d directives, %d passed in %s",
+		r.sourceName, r.ran, r.passed, elapsed.Round(time.Millisecond))
+}
+
+// preprocessInput applies the PreprocessInput function, if any, to the input
+// of the directive. This happens after the directive has been emitted for
+// rewrite, so the test file keeps the original input.
+func (r *testDataReader) preprocessInput(d *TestData) {
+	if r.opts.preprocessInput != nil {
+		d.Input = r.opts.preprocessInput(d.Cmd, d.Input)
+	}
+}
+
+// parallel returns true if top-level directives run in parallel; see
+// ParallelDirectives.
+func (r *testDataReader) parallel() bool {
+	return r.opts.parallelDirectives && r.rewrite == nil
+}
+
+// pos returns the position of the given line of the test file, for use in
+// TestData.Pos.
+func (r *testDataReader) pos(line int) string {
+	if r.opts.formatPos != nil {
+		return r.opts.formatPos(r.sourceName, line)
+	}
+	return fmt.Sprintf("%s:%d", r.sourceName, line)
+}
+
+// expandEnvArgs replaces references to environment variables in the argument
+// values, as configured by ExpandEnvArgs.
+func (r *testDataReader) expandEnvArgs(t Reporter, args []CmdArg) {
+	t.Helper()
+	for i := range args {
+		for j, val := range args[i].Vals {
+			args[i].Vals[j] = os.Expand(val, func(name string) string {
+				if name == "$" {
+					// Support escaping dollar signs as $$.
+					return "$"
+				}
+				v, ok := os.LookupEnv(name)
+				if !ok && r.opts.expandEnvStrict {
+					parseErrorf(t, r.data.Pos, ErrArgument,
+						"%s: environment variable %q is not set", args[i].Key, name)
+				}
+				return v
+			})
+		}
+	}
+}
+
+// resolveArgRefs replaces argument values of the form @<name> with the value
+// of the argument with that name, as configured by ArgRefs.
+func (r *testDataReader) resolveArgRefs(t Reporter, args []CmdArg) {
+	t.Helper()
+	for i := range args {
+		for j, val := range args[i].Vals {
+			if !strings.HasPrefix(val, "@") {
+				continue
+			}
+			name := val[1:]
+			var ref *CmdArg
+			for k := range args {
+				if args[k].Key == name {
+					ref = &args[k]
+					break
+				}
+			}
+			if ref == nil {
+				parseErrorf(t, r.data.Pos, ErrArgument, "%s: no argument %q to refer to", args[i].Key, name)
+			} else if len(ref.Vals) != 1 {
+				parseErrorf(t, r.data.Pos, ErrArgument,
+					"%s: argument %q must have a single value to be referred to", args[i].Key, name)
+			}
+			args[i].Vals[j] = ref.Vals[0]
+		}
+	}
+}
+
+// readFileArgs reads the files named by the arguments configured with
+// FileArgs, into TestData.argFiles.
+func (r *testDataReader) readFileArgs(t Reporter, args []CmdArg) {
+	t.Helper()
+	for _, arg := range args {
+		if !r.opts.fileArgs[arg.Key] {
+			continue
+		}
+		if len(arg.Vals) != 1 {
+			parseErrorf(t, r.data.Pos, ErrArgument, "%s: expected a single file name", arg.Key)
+		}
+		path := arg.Vals[0]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(r.sourceName), path)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			parseErrorf(t, r.data.Pos, ErrArgument, "%s: %v", arg.Key, err)
+		}
+		if r.data.argFiles == nil {
+			r.data.argFiles = make(map[string][]byte)
+		}
+		r.data.argFiles[arg.Key] = data
+	}
+}
+
+// commandRe matches directive lines which start with a command, or with several
+// comma-separated commands, when using the DefaultCmd option.
+var commandRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*(,[A-Za-z_][A-Za-z0-9_.-]*)*(\s|$)`)
+
+// isSeparator returns true if the line is a "----" separator. Surrounding
+// whitespace is ignored, so that separators mangled by editors (e.g. indented
+// with a tab or followed by trailing spaces) are still recognized.
+func isSeparator(line string) bool {
+	return strings.TrimSpace(line) == "----"
+}
+
+// annotationPrefix starts the comment lines which precede the expected results
+// of directives with the AnnotateRewrite option.
+const annotationPrefix = "# output of: "
+
+// isAnnotation returns true if the line is an annotation written with the
+// AnnotateRewrite option, which must immediately precede a separator.
+func (r *testDataReader) isAnnotation(line string) bool {
+	if !r.opts.annotateRewrite || !strings.HasPrefix(line, annotationPrefix) {
+		return false
+	}
+	next, ok := r.scanner.Peek(0)
+	if !ok {
+		return false
+	}
+	_, conditional := conditionalSeparator(next)
+	return conditional || isSeparator(next)
+}
+
+// conditionalSeparatorRe matches the separators preceding conditional
+// expected blocks, like "---- if=linux".
+var conditionalSeparatorRe = regexp.MustCompile(`^\s*----\s+if=(\S+)\s*$`)
+
+// conditionalSeparator returns the key of a conditional separator line. The
+// second return value is false if the line isn't one.
+func conditionalSeparator(line string) (key string, ok bool) {
+	m := conditionalSeparatorRe.FindStringSubmatch(line)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// escapedSeparatorRe matches lines of expected results which consist of a
+// separator preceded by backslashes. Such lines stand for the same line with
+// one less backslash, which allows expected results to contain separators.
+var escapedSeparatorRe = regexp.MustCompile(`^(\s*)\\(\\*----\s*)$`)
+
+// unescapeSeparator returns the line of expected results as it must appear in
+// the actual results.
+func unescapeSeparator(line string) string {
+	return escapedSeparatorRe.ReplaceAllString(line, "$1$2")
+}
+
+// separatorLineRe matches the lines of actual results which must be escaped
+// when rewriting; see escapedSeparatorRe.
+var separatorLineRe = regexp.MustCompile(`(?m)^([ \t]*)(\\*----[ \t]*)$`)
+
+// escapeSeparators escapes the lines of the actual results which would
+// otherwise be read as separators, or be unescaped.
+func escapeSeparators(actual string) string {
+	if !strings.Contains(actual, "----") {
+		return actual
+	}
+	return separatorLineRe.ReplaceAllString(actual, `$1\$2`)
+}
+
+// emitActual emits the expected block for the given actual output during
+// rewrite, using the double separator syntax if it contains blank lines. The
+// leading "----" separator must have been emitted already.
+func (r *testDataReader) emitActual(actual string) {
+	actual = escapeSeparators(actual)
+	if hasBlankLine(actual) {
+		r.emit("----")
+		r.rewrite.WriteString(actual)
+		r.emit("----")
+		r.emit("----")
+		r.emit("")
+	} else {
+		// Here actual already ends in \n so emit adds a blank line.
+		r.emit(actual)
+	}
+}
+
+// emitExpected emits the expected block of the directive during rewrite:
+// either the given actual output, or the block as it was read from the file
+// if it must be preserved. For directives with conditional expected results,
+// only the active block is updated and the other ones are preserved.
+func (r *testDataReader) emitExpected(d *TestData, actual string) {
+	if r.opts.annotateRewrite {
+		r.emit(annotationPrefix + RenderDirective(d.Cmd, d.CmdArgs, false /* sortArgs */))
+	}
+	if d.variants == nil {
+		r.emit("----")
+		if r.preserveExpected(d, actual) {
+			r.emitRawExpected(d.rawExpected)
+		} else {
+			r.emitActual(r.restoreInlineComments(d.Expected, actual))
+		}
+		return
+	}
+	for i, v := range d.variants {
+		r.emit(v.separator)
+		if i == d.activeVariant && !r.preserveExpected(d, actual) {
+			r.emitActual(r.restoreInlineComments(d.Expected, actual))
+		} else {
+			r.emitRawExpected(v.rawExpected)
+		}
+	}
+}
+
+// emitRawExpected emits an expected block exactly as it was read from the
+// file. The leading "----" separator must have been emitted already.
+func (r *testDataReader) emitRawExpected(rawExpected []string) {
+	for _, line := range rawExpected {
+		r.emit(line)
+	}
+	r.emit("")
+}
+
+// flushRewrite writes the rewritten contents buffered so far to the rewriteOut
+// writer, if any. This happens between directives, so that the buffer only
+// holds the contents for the current directive. The last few bytes are kept
+// in the buffer, since a trailing blank line is removed at the end.
+func (r *testDataReader) flushRewrite(t Reporter) {
+	t.Helper()
+	const keep = 3
+	if r.rewrite == nil || r.opts.rewriteOut == nil || r.rewrite.Len() <= keep {
+		return
+	}
+	if _, err := r.opts.rewriteOut.Write(r.rewrite.Next(r.rewrite.Len() - keep)); err != nil {
+		t.Fatalf("%s: %v", r.sourceName, err)
+	}
 }
 
 func (r *testDataReader) emit(s string) {
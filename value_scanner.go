@@ -0,0 +1,60 @@
+// Copyright 2026 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package datadriven
+
+import (
+	"strings"
+	"sync"
+)
+
+// valueScanners holds the scanners registered with RegisterValueScanner, by
+// prefix.
+var valueScanners struct {
+	mu sync.RWMutex
+	m  map[string]func(val string, dest interface{}) error
+}
+
+// RegisterValueScanner registers fn to scan argument values which start with
+// prefix into ScanArgs destinations of types that ScanArgs doesn't otherwise
+// support, like pointers to structs. fn is passed the value without the prefix.
+// It is typically called from an init function; see the yamlscan package,
+// which registers the yaml: prefix.
+func RegisterValueScanner(prefix string, fn func(val string, dest interface{}) error) {
+	valueScanners.mu.Lock()
+	defer valueScanners.mu.Unlock()
+	if valueScanners.m == nil {
+		valueScanners.m = make(map[string]func(val string, dest interface{}) error)
+	}
+	valueScanners.m[prefix] = fn
+}
+
+// scanRegistered scans a value into dest with the scanner registered for the
+// value's prefix, preferring the longest registered prefix. The second return
+// value is false if there is no such scanner.
+func scanRegistered(val string, dest interface{}) (bool, error) {
+	valueScanners.mu.RLock()
+	defer valueScanners.mu.RUnlock()
+	var prefix string
+	var fn func(val string, dest interface{}) error
+	for p, f := range valueScanners.m {
+		if strings.HasPrefix(val, p) && (fn == nil || len(p) > len(prefix)) {
+			prefix, fn = p, f
+		}
+	}
+	if fn == nil {
+		return false, nil
+	}
+	return true, fn(strings.TrimPrefix(val, prefix), dest)
+}
@@ -0,0 +1,37 @@
+// Copyright 2026 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package yamlscan lets datadriven's ScanArgs unmarshal argument values of the
+// form yaml:<document> into destinations like pointers to structs, using
+// gopkg.in/yaml.v3. It is imported for its side effect:
+//
+//	import _ "github.com/cockroachdb/datadriven/yamlscan"
+//
+// Keeping it in a separate package means that importers of datadriven which
+// don't need YAML values don't depend on the YAML library.
+package yamlscan
+
+import (
+	"github.com/cockroachdb/datadriven"
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix is the prefix of argument values which are unmarshaled as YAML.
+const Prefix = "yaml:"
+
+func init() {
+	datadriven.RegisterValueScanner(Prefix, func(val string, dest interface{}) error {
+		return yaml.Unmarshal([]byte(val), dest)
+	})
+}
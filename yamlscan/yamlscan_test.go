@@ -0,0 +1,57 @@
+// Copyright 2026 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package yamlscan_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cockroachdb/datadriven"
+	_ "github.com/cockroachdb/datadriven/yamlscan"
+)
+
+// fatalTB turns fatal errors into panics, so that tests can check them.
+type fatalTB struct {
+	*testing.T
+}
+
+func (t fatalTB) Fatalf(format string, args ...interface{}) {
+	panic(fmt.Sprintf(format, args...))
+}
+
+func TestScanYAML(t *testing.T) {
+	type config struct {
+		Name  string `yaml:"name"`
+		Sizes []int  `yaml:"sizes"`
+	}
+	datadriven.RunTestFromString(t, `
+scan cfg="yaml:{name: foo, sizes: [1, 2]}"
+----
+{Name:foo Sizes:[1 2]}
+
+scan cfg="yaml:{name: [}"
+----
+error: <string>:6: cfg: failed to scan argument 0: yaml: did not find expected node content
+`, func(t *testing.T, d *datadriven.TestData) (res string) {
+		defer func() {
+			if r := recover(); r != nil {
+				res = fmt.Sprintf("error: %v", r)
+			}
+		}()
+		var c config
+		d.ScanArgs(fatalTB{t}, "cfg", &c)
+		return fmt.Sprintf("%+v", c)
+	}, datadriven.QuotedArgs())
+}